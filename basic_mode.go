@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var basicModeCommands = []*cli.Command{
+	{
+		Name:  "learnmode",
+		Usage: "Put the CI in learn mode until interrupted, to assign sensors",
+		Action: func(c *cli.Context) error {
+			return runCommand(c, commandHandler{}, true, func(ctx context.Context, iface *xc.Interface) error {
+				if err := iface.LearnMode(ctx, true); err != nil {
+					return err
+				}
+				log.Println("CI in learn mode, operate the sensors to assign; press Ctrl-C when done")
+
+				<-ctx.Done()
+
+				return iface.LearnMode(context.WithoutCancel(ctx), false)
+			})
+		},
+	},
+	{
+		Name:      "assign",
+		Usage:     "Assign datapoint to the actuator in learn mode",
+		ArgsUsage: "<datapoint>",
+		Action: func(c *cli.Context) error {
+			return basicModeCommand(c, (*xc.Interface).AssignActuator)
+		},
+	},
+	{
+		Name:      "remove-actuator",
+		Usage:     "Remove datapoint assignment from the actuator in learn mode",
+		ArgsUsage: "<datapoint>",
+		Action: func(c *cli.Context) error {
+			return basicModeCommand(c, (*xc.Interface).RemoveActuator)
+		},
+	},
+	{
+		Name:      "remove-sensor",
+		Usage:     "Remove sensor assigned to datapoint",
+		ArgsUsage: "<datapoint>",
+		Action: func(c *cli.Context) error {
+			return basicModeCommand(c, (*xc.Interface).RemoveSensor)
+		},
+	},
+}
+
+func basicModeCommand(c *cli.Context,
+	fn func(*xc.Interface, context.Context, int) error) error {
+
+	dp, err := strconv.Atoi(c.Args().First())
+	if err != nil || dp < 0 || dp > 255 {
+		return errors.Errorf("invalid datapoint '%s'", c.Args().First())
+	}
+
+	return runCommand(c, commandHandler{}, true, func(ctx context.Context, iface *xc.Interface) error {
+		if err := fn(iface, ctx, dp); err != nil {
+			return err
+		}
+		log.Printf("%s datapoint %d: done", c.Command.Name, dp)
+		return nil
+	})
+}
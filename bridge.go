@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// Number of frames queued for a client before frames are dropped
+const bridgeClientQueue = 64
+
+var bridgeFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "listen",
+		Value: fmt.Sprintf(":%d", eciPort),
+		Usage: "Address to accept controlling clients on",
+	},
+	&cli.StringFlag{
+		Name:  "monitor-listen",
+		Usage: "Address to accept read-only monitor clients on, e.g. :7154",
+	},
+	&cli.BoolFlag{
+		Name:  "multiplex",
+		Usage: "Let several clients control the CI at the same time",
+	},
+}
+
+// bridgeCommand serves a local CI over TCP, so that it can be used as an ECI
+// from elsewhere
+func bridgeCommand(c *cli.Context) error {
+	ctx, cancel := signalContext(context.Background())
+	defer cancel()
+
+	log.SetOutput(logRedacter{log.Writer()})
+
+	devCtx, closeDevices := context.WithCancel(context.Background())
+	defer closeDevices()
+
+	devices, done, err := openAllDevices(devCtx, c, true)
+	defer done()
+	if err != nil {
+		return err
+	}
+
+	if len(devices) == 0 {
+		return errors.New("no devices found")
+	} else if len(devices) > 1 {
+		log.Printf("Found %d CIs, bridging the first", len(devices))
+	}
+
+	b := newBridge(devices[0], c.Bool("verbose"))
+	if c.Bool("multiplex") {
+		b.mux = newMultiplexer()
+	}
+
+	return b.Serve(ctx, c.String("listen"), c.String("monitor-listen"))
+}
+
+type bridgeClient struct {
+	conn   io.ReadWriteCloser
+	frames chan []byte
+	name   string
+}
+
+// bridge relays frames between a CI and TCP clients, framed like an ECI.
+// Only one client at a time may control the CI, unless multiplexing,
+// while any number of monitor clients receive the frames sent by the CI.
+type bridge struct {
+	device  io.ReadWriter
+	verbose bool
+	// nil unless multiplexing
+	mux *multiplexer
+
+	m           sync.Mutex
+	controllers map[*bridgeClient]bool
+	monitors    map[*bridgeClient]bool
+}
+
+func newBridge(device io.ReadWriter, verbose bool) *bridge {
+	return &bridge{
+		device:      device,
+		verbose:     verbose,
+		controllers: make(map[*bridgeClient]bool),
+		monitors:    make(map[*bridgeClient]bool),
+	}
+}
+
+// Serve relays frames until ctx is cancelled or reading from the CI fails
+func (b *bridge) Serve(ctx context.Context, listen, monitorListen string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var lc net.ListenConfig
+
+	listener, err := lc.Listen(ctx, "tcp", listen)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.Printf("Accepting controlling clients on %s", listener.Addr())
+	go b.accept(listener, false)
+
+	if monitorListen != "" {
+		monitorListener, err := lc.Listen(ctx, "tcp", monitorListen)
+		if err != nil {
+			listener.Close()
+			return errors.WithStack(err)
+		}
+		log.Printf("Accepting monitor clients on %s", monitorListener.Addr())
+		go b.accept(monitorListener, true)
+
+		defer monitorListener.Close()
+	}
+	defer listener.Close()
+
+	readFailed := make(chan error, 1)
+	go func() {
+		readFailed <- b.readDevice()
+		cancel()
+	}()
+
+	<-ctx.Done()
+	b.closeClients()
+
+	select {
+	case err := <-readFailed:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (b *bridge) accept(listener net.Listener, monitor bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		client := &bridgeClient{
+			conn:   xc.StartStopWrap(conn),
+			frames: make(chan []byte, bridgeClientQueue),
+			name:   conn.RemoteAddr().String(),
+		}
+
+		if !b.add(client, monitor) {
+			log.Printf("Refusing %s, the CI is already controlled by another client", client.name)
+			conn.Close()
+			continue
+		}
+
+		go b.writeClient(client)
+		if !monitor {
+			go b.readClient(client)
+		}
+	}
+}
+
+func (b *bridge) add(client *bridgeClient, monitor bool) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if monitor {
+		log.Printf("Monitor client %s connected", client.name)
+		b.monitors[client] = true
+	} else {
+		if len(b.controllers) > 0 && b.mux == nil {
+			return false
+		}
+		log.Printf("Controlling client %s connected", client.name)
+		b.controllers[client] = true
+	}
+
+	return true
+}
+
+// remove disconnects a client, unless already done
+func (b *bridge) remove(client *bridgeClient) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.controllers[client] {
+		delete(b.controllers, client)
+		if b.mux != nil {
+			b.mux.forget(client)
+		}
+	} else if b.monitors[client] {
+		delete(b.monitors, client)
+	} else {
+		return
+	}
+
+	log.Printf("Client %s disconnected", client.name)
+	close(client.frames)
+	client.conn.Close()
+}
+
+func (b *bridge) closeClients() {
+	b.m.Lock()
+	clients := make([]*bridgeClient, 0, len(b.controllers)+len(b.monitors))
+	for client := range b.controllers {
+		clients = append(clients, client)
+	}
+	for client := range b.monitors {
+		clients = append(clients, client)
+	}
+	b.m.Unlock()
+
+	for _, client := range clients {
+		b.remove(client)
+	}
+}
+
+// readDevice passes frames from the CI to all clients, dropping frames for
+// clients that don't keep up
+func (b *bridge) readDevice() error {
+	buf := make([]byte, 256)
+	for {
+		n, err := b.device.Read(buf)
+		if errors.Is(err, xc.ErrStartStopByte) {
+			// Framing lost; keep reading until the next start byte
+			if b.verbose {
+				log.Printf("Resyncing with CI: %v", err)
+			}
+			continue
+		} else if err != nil {
+			return errors.WithStack(err)
+		} else if n == 0 {
+			continue
+		}
+
+		length := int(buf[0])
+		if length == 0 || length > n {
+			log.Printf("Dropping malformed frame from CI [%s]", hex.EncodeToString(buf[:n]))
+			continue
+		}
+
+		frame := make([]byte, length)
+		copy(frame, buf[:length])
+		if b.verbose {
+			log.Printf("CI: [%s]", hex.EncodeToString(frame[1:]))
+		}
+
+		// Monitors get everything, but when multiplexing, responses to
+		// TX commands only go to the sender
+		var target *bridgeClient
+		forward := frame
+		if b.mux != nil {
+			target, forward = b.mux.fromCI(frame)
+		}
+
+		b.m.Lock()
+		if target != nil {
+			if b.controllers[target] {
+				b.queue(target, forward)
+			}
+		} else if forward != nil {
+			for client := range b.controllers {
+				b.queue(client, forward)
+			}
+		}
+		for client := range b.monitors {
+			b.queue(client, frame)
+		}
+		b.m.Unlock()
+	}
+}
+
+func (b *bridge) queue(client *bridgeClient, frame []byte) {
+	select {
+	case client.frames <- frame:
+	default:
+		log.Printf("Client %s isn't keeping up, dropping frame", client.name)
+	}
+}
+
+func (b *bridge) writeClient(client *bridgeClient) {
+	for frame := range client.frames {
+		if _, err := client.conn.Write(frame); err != nil {
+			go b.remove(client)
+			break
+		}
+	}
+
+	// Let remove close the channel
+	for range client.frames {
+	}
+}
+
+// readClient passes frames from the controlling client to the CI
+func (b *bridge) readClient(client *bridgeClient) {
+	defer b.remove(client)
+
+	buf := make([]byte, 256)
+	for {
+		n, err := client.conn.Read(buf)
+		if errors.Is(err, xc.ErrStartStopByte) {
+			if b.verbose {
+				log.Printf("Resyncing with %s: %v", client.name, err)
+			}
+			continue
+		} else if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Reading from %s: %v", client.name, err)
+			}
+			return
+		} else if n == 0 {
+			continue
+		}
+
+		if b.verbose {
+			log.Printf("%s: [%s]", client.name, hex.EncodeToString(buf[1:n]))
+		}
+
+		frame := buf[:n]
+		if b.mux != nil {
+			if frame, err = b.mux.toCI(client, frame); err != nil {
+				log.Printf("Dropping frame from %s: %v", client.name, err)
+				continue
+			}
+		}
+		if _, err := b.device.Write(frame); err != nil {
+			log.Printf("Writing to CI: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var identityFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "ci-alias",
+		Usage: "MQTT client id and topic prefix for the CI with the given serial number, as serial=alias",
+	},
+	&cli.BoolFlag{
+		Name:  "ci-id-serial",
+		Usage: "Suffix the MQTT client id with the CI serial number rather than its index, for CIs without an alias",
+	},
+	&cli.StringFlag{
+		Name:  "ci-ids",
+		Usage: "Record the MQTT client id given to each CI by serial number in this file, so that the CI keeps it when other CIs are added or removed; CIs are numbered by index if not set",
+	},
+}
+
+// ciAliases parses the --ci-alias flags
+func ciAliases(c *cli.Context) (map[uint32]string, error) {
+	aliases := make(map[uint32]string)
+
+	for _, alias := range c.StringSlice("ci-alias") {
+		serial, name, found := strings.Cut(alias, "=")
+		if !found || name == "" {
+			return nil, errors.Errorf("invalid --ci-alias '%s', expected serial=alias", alias)
+		}
+
+		number, err := strconv.ParseUint(serial, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid serial number in --ci-alias '%s'", alias)
+		}
+
+		aliases[uint32(number)] = name
+	}
+
+	return aliases, nil
+}
+
+// ciClientId returns the MQTT client id, which is also the topic prefix,
+// of the CI with the given serial number, opened as number id.  The serial
+// number is 0 for CIs that can't be identified, such as bridge monitors,
+// which are always numbered by index.
+func ciClientId(c *cli.Context, serial uint32, id int) (string, error) {
+	aliases, err := ciAliases(c)
+	if err != nil {
+		return "", err
+	}
+
+	switch alias, found := aliases[serial]; {
+	case found && serial != 0:
+		return alias, nil
+	case c.Bool("ci-id-serial") && serial != 0:
+		return fmt.Sprintf("%s-%d", c.String("client-id"), serial), nil
+	case c.String("ci-ids") != "" && serial != 0:
+		return recordedClientId(c.String("ci-ids"), c.String("client-id"), serial, id)
+	default:
+		return indexedClientId(c.String("client-id"), id), nil
+	}
+}
+
+// indexedClientId returns the client id of the CI opened as number id
+func indexedClientId(clientId string, id int) string {
+	if id > 0 {
+		return fmt.Sprintf("%s-%d", clientId, id)
+	}
+	return clientId
+}
+
+// ciIdsMutex serializes access to the ci-ids file, as CIs are identified
+// in parallel
+var ciIdsMutex sync.Mutex
+
+// recordedClientId returns the client id recorded for the CI with the
+// given serial number in filename.  A CI not seen before is given the
+// client id of its index, as without the file, unless another CI already
+// has it, in which case the first free index is used, and the file is
+// updated.
+func recordedClientId(filename, clientId string, serial uint32, id int) (string, error) {
+	ciIdsMutex.Lock()
+	defer ciIdsMutex.Unlock()
+
+	ids := make(map[string]string)
+
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return "", errors.Wrapf(err, "reading %s", filename)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", errors.WithStack(err)
+	}
+
+	key := strconv.FormatUint(uint64(serial), 10)
+	if recorded, found := ids[key]; found {
+		return recorded, nil
+	}
+
+	used := make(map[string]bool)
+	for _, recorded := range ids {
+		used[recorded] = true
+	}
+
+	next := indexedClientId(clientId, id)
+	for n := 0; used[next]; n++ {
+		next = indexedClientId(clientId, n)
+	}
+	ids[key] = next
+
+	// The client id is still used if it can't be recorded, it just won't
+	// be kept if the CIs change
+	if data, err = json.MarshalIndent(ids, "", "  "); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		log.Printf("Couldn't record client id %s for CI %d: %v", next, serial, err)
+	} else {
+		log.Printf("Recorded client id %s for CI %d in %s", next, serial, filename)
+	}
+
+	return next, nil
+}
+
+// ciFileLabel returns the alias of the CI with the given serial number, or
+// else the serial number, for naming the files kept for the CI
+func ciFileLabel(c *cli.Context, serial uint32) (string, error) {
+	aliases, err := ciAliases(c)
+	if err != nil {
+		return "", err
+	}
+
+	if alias, found := aliases[serial]; found {
+		return alias, nil
+	}
+	return strconv.FormatUint(uint64(serial), 10), nil
+}
+
+// deferredHandler holds back callbacks from the interface until start is
+// called, so that the CI can be identified before the handler is set up
+type deferredHandler struct {
+	m       sync.Mutex
+	handler xc.Handler
+	pending []func(h xc.Handler)
+}
+
+// start passes the callbacks held back so far, and all later callbacks,
+// to h
+func (d *deferredHandler) start(h xc.Handler) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	for _, fn := range d.pending {
+		fn(h)
+	}
+	d.pending = nil
+	d.handler = h
+}
+
+func (d *deferredHandler) call(fn func(h xc.Handler)) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.handler == nil {
+		d.pending = append(d.pending, fn)
+	} else {
+		fn(d.handler)
+	}
+}
+
+func (d *deferredHandler) StatusValue(datapoint *xc.Datapoint, value int) {
+	d.call(func(h xc.Handler) { h.StatusValue(datapoint, value) })
+}
+
+func (d *deferredHandler) StatusBool(datapoint *xc.Datapoint, on bool) {
+	d.call(func(h xc.Handler) { h.StatusBool(datapoint, on) })
+}
+
+func (d *deferredHandler) StatusShutter(datapoint *xc.Datapoint, status xc.ShutterStatus) {
+	d.call(func(h xc.Handler) { h.StatusShutter(datapoint, status) })
+}
+
+func (d *deferredHandler) Event(datapoint *xc.Datapoint, event xc.Event) {
+	d.call(func(h xc.Handler) { h.Event(datapoint, event) })
+}
+
+func (d *deferredHandler) Wheel(datapoint *xc.Datapoint, value interface{}) {
+	d.call(func(h xc.Handler) { h.Wheel(datapoint, value) })
+}
+
+func (d *deferredHandler) Valve(datapoint *xc.Datapoint, position int) {
+	d.call(func(h xc.Handler) { h.Valve(datapoint, position) })
+}
+
+func (d *deferredHandler) ValueEvent(datapoint *xc.Datapoint, event xc.Event, value interface{}) {
+	d.call(func(h xc.Handler) { h.ValueEvent(datapoint, event, value) })
+}
+
+func (d *deferredHandler) Value(datapoint *xc.Datapoint, value interface{}) {
+	d.call(func(h xc.Handler) { h.Value(datapoint, value) })
+}
+
+func (d *deferredHandler) Battery(device *xc.Device, percentage int) {
+	d.call(func(h xc.Handler) { h.Battery(device, percentage) })
+}
+
+func (d *deferredHandler) Power(device *xc.Device, value interface{}) {
+	d.call(func(h xc.Handler) { h.Power(device, value) })
+}
+
+func (d *deferredHandler) InternalTemperature(device *xc.Device, centigrade int) {
+	d.call(func(h xc.Handler) { h.InternalTemperature(device, centigrade) })
+}
+
+func (d *deferredHandler) Rssi(device *xc.Device, rssi int) {
+	d.call(func(h xc.Handler) { h.Rssi(device, rssi) })
+}
+
+func (d *deferredHandler) DPLChanged(diff xc.DPLDiff) {
+	d.call(func(h xc.Handler) { h.DPLChanged(diff) })
+}
+
+func (d *deferredHandler) SensorAssigned(number int) {
+	d.call(func(h xc.Handler) { h.SensorAssigned(number) })
+}
+
+func (d *deferredHandler) UnknownTraffic(entry xc.UnknownTraffic) {
+	d.call(func(h xc.Handler) { h.UnknownTraffic(entry) })
+}
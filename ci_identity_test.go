@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+type ciOpened struct {
+	serial uint32
+	id     int
+	want   string
+}
+
+func TestRecordedClientId(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorded map[string]string
+		opened   []ciOpened
+		want     map[string]string
+	}{
+		{
+			name: "numbered by index",
+			opened: []ciOpened{
+				{111, 0, "xcomfort"},
+				{222, 1, "xcomfort-1"},
+				{111, 0, "xcomfort"},
+			},
+			want: map[string]string{"111": "xcomfort", "222": "xcomfort-1"},
+		},
+		{
+			name:     "CI removed",
+			recorded: map[string]string{"111": "xcomfort", "222": "xcomfort-1"},
+			opened: []ciOpened{
+				{222, 0, "xcomfort-1"},
+			},
+			want: map[string]string{"111": "xcomfort", "222": "xcomfort-1"},
+		},
+		{
+			name:     "CI added in front",
+			recorded: map[string]string{"222": "xcomfort"},
+			opened: []ciOpened{
+				{111, 0, "xcomfort-1"},
+				{222, 1, "xcomfort"},
+			},
+			want: map[string]string{"111": "xcomfort-1", "222": "xcomfort"},
+		},
+		{
+			name:     "first free index",
+			recorded: map[string]string{"111": "xcomfort", "222": "xcomfort-2"},
+			opened: []ciOpened{
+				{333, 2, "xcomfort-1"},
+				{444, 0, "xcomfort-3"},
+			},
+			want: map[string]string{"111": "xcomfort", "222": "xcomfort-2",
+				"333": "xcomfort-1", "444": "xcomfort-3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "ci-ids.json")
+			if test.recorded != nil {
+				data, err := json.Marshal(test.recorded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, ci := range test.opened {
+				got, err := recordedClientId(filename, "xcomfort", ci.serial, ci.id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != ci.want {
+					t.Errorf("CI %d opened as %d: got %s, expected %s", ci.serial, ci.id, got, ci.want)
+				}
+			}
+
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorded := make(map[string]string)
+			if err := json.Unmarshal(data, &recorded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(recorded, test.want) {
+				t.Errorf("recorded %v, expected %v", recorded, test.want)
+			}
+		})
+	}
+}
+
+// identityContext returns a cli context with the identity flags set from
+// args
+func identityContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := append([]cli.Flag{&cli.StringFlag{Name: "client-id", Value: "xcomfort"}}, identityFlags...)
+	for _, f := range flags {
+		if err := f.Apply(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestClientIdWithoutRecord(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	// Nothing is recorded unless --ci-ids is given
+	c := identityContext(t)
+	for id, want := range []string{"xcomfort", "xcomfort-1"} {
+		got, err := ciClientId(c, uint32(222+id), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("CI opened as %d: got %s, expected %s", id, got, want)
+		}
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("created %s", entries[0].Name())
+	}
+}
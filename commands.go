@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var commands = []*cli.Command{
+	{
+		Name:   "list",
+		Usage:  "List CIs with serial number and firmware",
+		Action: listCommand,
+	},
+	{
+		Name:      "dump-dpl",
+		Usage:     "Read the datapoint list from the CI eprom and save it to file",
+		ArgsUsage: "<filename.dpl>",
+		Action:    dumpDplCommand,
+	},
+	{
+		Name:      "show",
+		Usage:     "Show devices and datapoints in a DPL or TXT file",
+		ArgsUsage: "<filename>",
+		Action:    showCommand,
+	},
+	{
+		Name:      "send",
+		Usage:     "Send a command to a datapoint and report the acknowledgement",
+		ArgsUsage: "<datapoint> on|off|dim <0-100>|open|close|stop|stepopen|stepclose",
+		Action:    sendCommand,
+	},
+	{
+		Name:   "monitor",
+		Usage:  "Print received messages until interrupted, without MQTT",
+		Action: monitorCommand,
+	},
+	{
+		Name:      "rs232",
+		Usage:     "Show or change the serial port configuration of the CI",
+		ArgsUsage: "[baud <rate>|flow on|off|crc off]",
+		Action:    rs232Command,
+	},
+	{
+		Name:   "bridge",
+		Usage:  "Serve the CI over TCP, so that it can be used as an ECI from elsewhere",
+		Flags:  bridgeFlags,
+		Action: bridgeCommand,
+	},
+	{
+		Name:   "unknown",
+		Usage:  "Collect traffic that couldn't be decoded until interrupted, and print it as JSON",
+		Action: unknownCommand,
+	},
+}
+
+// runCommand opens the first CI found, starts the event loop and calls fn
+// once the CI is ready.  The context passed to fn is cancelled on SIGINT or
+// SIGTERM, while the CI stays usable until fn returns.  Datapoints are
+// loaded first if datapoints is set.
+func runCommand(c *cli.Context, handler xc.Handler, datapoints bool,
+	fn func(ctx context.Context, iface *xc.Interface) error) error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log.SetOutput(logRedacter{log.Writer()})
+
+	devices, done, err := openAllDevices(ctx, c, true)
+	defer done()
+	if err != nil {
+		return err
+	}
+
+	if len(devices) == 0 {
+		return errors.New("no devices found")
+	}
+
+	return runInterface(ctx, devices[0], c, handler, datapoints, fn)
+}
+
+// runInterface starts the event loop on conn and calls fn once the CI is
+// ready.  If datapoints is set, datapoints are loaded from file or eprom as
+// requested.
+func runInterface(parent context.Context, conn io.ReadWriter, c *cli.Context, handler xc.Handler,
+	datapoints bool, fn func(ctx context.Context, iface *xc.Interface) error) error {
+
+	runCtx, stop := context.WithCancel(parent)
+	defer stop()
+
+	iface := &xc.Interface{}
+	iface.Init(handler, c.Bool("verbose"))
+
+	policy, err := retryPolicy(c)
+	if err != nil {
+		return err
+	}
+	iface.SetRetryPolicy(policy)
+
+	if datapoints && c.String("overrides") != "" {
+		if err := iface.ReadOverrides(c.String("overrides")); err != nil {
+			return err
+		}
+	}
+
+	if datapoints && c.String("file") != "" {
+		if err := iface.ReadFile(c.String("file")); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := signalContext(runCtx)
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- iface.Run(runCtx, conn)
+		// Nothing more to do once the event loop has stopped, e.g. at
+		// the end of a replay
+		cancel()
+	}()
+
+	err = func() error {
+		if isMonitor(conn) {
+			// Bridge monitors only receive, so can't be set up
+			return fn(ctx, iface)
+		}
+
+		if err := iface.SetOKMRF(ctx); err != nil {
+			return err
+		}
+		if err := iface.SetRfSeqNo(ctx); err != nil {
+			return err
+		}
+
+		if datapoints && c.Bool("eprom") {
+			if err := iface.RequestDPL(ctx); err != nil {
+				return err
+			}
+		}
+
+		return fn(ctx, iface)
+	}()
+
+	stop()
+	<-runErr
+
+	return err
+}
+
+func listCommand(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log.SetOutput(logRedacter{log.Writer()})
+
+	devices, done, err := openAllDevices(ctx, c, true)
+	defer done()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i := range devices {
+		if monitor, ok := devices[i].(*monitorDevice); ok {
+			fmt.Printf("CI %d: bridge monitor (%s)\n", i, monitor.address)
+			continue
+		}
+
+		if err := runInterface(ctx, devices[i], c, commandHandler{}, false,
+			func(ctx context.Context, iface *xc.Interface) error {
+				serial, err := iface.Serial(ctx)
+				if err != nil {
+					return err
+				}
+				hwrev, rfrev, fwrev, err := iface.Revision(ctx)
+				if err != nil {
+					return err
+				}
+				rf, fw, err := iface.Release(ctx)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("CI %d: serial %d, HW/RF/FW revision %d, %.1f, %d, RF/Firmware release %.2f, %.2f\n",
+					i, serial, hwrev, float32(rfrev)/10, fwrev, rf, fw)
+				return nil
+			}); err != nil {
+			fmt.Printf("CI %d: %v\n", i, err)
+			failed++
+		}
+	}
+
+	if len(devices) == 0 {
+		fmt.Println("No devices found")
+	} else if failed > 0 {
+		return errors.Errorf("%d of %d CIs couldn't be queried", failed, len(devices))
+	}
+
+	return nil
+}
+
+func dumpDplCommand(c *cli.Context) error {
+	filename := c.Args().First()
+	if filename == "" {
+		return errors.New("missing filename")
+	}
+
+	return runCommand(c, commandHandler{}, false, func(ctx context.Context, iface *xc.Interface) error {
+		if err := iface.RequestDPL(ctx); err != nil {
+			return err
+		}
+
+		if err := iface.SaveDPL(filename); err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.Printf("Saved datapoint list to %s", filename)
+		return nil
+	})
+}
+
+func showCommand(c *cli.Context) error {
+	filename := c.Args().First()
+	if filename == "" {
+		return errors.New("missing filename")
+	}
+
+	iface := &xc.Interface{}
+	iface.Init(commandHandler{}, c.Bool("verbose"))
+
+	if c.String("overrides") != "" {
+		if err := iface.ReadOverrides(c.String("overrides")); err != nil {
+			return err
+		}
+	}
+
+	if err := iface.ReadFile(filename); err != nil {
+		return err
+	}
+
+	var devices []*xc.Device
+	iface.ForEachDevice(func(d *xc.Device) error {
+		devices = append(devices, d)
+		return nil
+	})
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].SerialNumber() < devices[j].SerialNumber()
+	})
+
+	for _, d := range devices {
+		fmt.Printf("Device %d: %s, '%s'", d.SerialNumber(), d.Type(), d.Name())
+		if d.SoftwareVersion() != "" {
+			fmt.Printf(", SW version %s", d.SoftwareVersion())
+		}
+		fmt.Println()
+
+		for _, dp := range d.Datapoints() {
+			fmt.Printf("  Datapoint %d: channel %d, mode %d, '%s'",
+				dp.Number(), dp.Channel(), dp.Mode(), dp.Name())
+			if !dp.Location().IsZero() {
+				fmt.Printf(", location %s", dp.Location())
+			}
+			fmt.Println()
+		}
+	}
+
+	return nil
+}
+
+func sendCommand(c *cli.Context) error {
+	args := c.Args()
+
+	number, err := strconv.Atoi(args.Get(0))
+	if err != nil {
+		return errors.Errorf("invalid datapoint '%s'", args.Get(0))
+	}
+
+	return runCommand(c, commandHandler{}, true, func(ctx context.Context, iface *xc.Interface) error {
+		dp := iface.Datapoint(number)
+		if dp == nil {
+			return errors.Errorf("unknown datapoint %d, use --file or --eprom", number)
+		}
+
+		var res xc.TxResult
+
+		switch args.Get(1) {
+		case "on", "off":
+			res, err = dp.Switch(ctx, args.Get(1) == "on")
+		case "dim":
+			value, convErr := strconv.Atoi(args.Get(2))
+			if convErr != nil || value < 0 || value > 100 {
+				return errors.Errorf("invalid dim value '%s', expected 0-100", args.Get(2))
+			}
+			res, err = dp.Dim(ctx, value)
+		case "open":
+			res, err = dp.Shutter(ctx, xc.ShutterOpen)
+		case "close":
+			res, err = dp.Shutter(ctx, xc.ShutterClose)
+		case "stop":
+			res, err = dp.Shutter(ctx, xc.ShutterStop)
+		case "stepopen":
+			res, err = dp.Shutter(ctx, xc.ShutterStepOpen)
+		case "stepclose":
+			res, err = dp.Shutter(ctx, xc.ShutterStepClose)
+		default:
+			return errors.Errorf("unknown command '%s'", args.Get(1))
+		}
+		if err != nil && !errors.Is(err, xc.ErrDatapointRemoved) {
+			return err
+		}
+
+		if res.Discarded {
+			fmt.Printf("Datapoint %d: command discarded\n", number)
+			return nil
+		}
+		fmt.Printf("Datapoint %d: ack %s, %d retries, %s\n", number, res.Ack, res.Retries, res.Latency)
+		// Acknowledged, but the CI no longer has the datapoint
+		return err
+	})
+}
+
+func rs232Command(c *cli.Context) error {
+	args := c.Args()
+
+	return runCommand(c, commandHandler{}, false, func(ctx context.Context, iface *xc.Interface) error {
+		var err error
+		switch args.First() {
+		case "":
+		case "baud":
+			baud, err := strconv.Atoi(args.Get(1))
+			if err != nil {
+				return errors.Wrapf(err, "invalid baud rate '%s'", args.Get(1))
+			}
+			// Rates the serial port can't be opened at, e.g. 14400, would
+			// leave the CI unreachable
+			if !serialSpeedSupported(baud) {
+				return errors.Errorf("unsupported baud rate %d", baud)
+			}
+			if err := iface.SetRS232Baud(ctx, baud); err != nil {
+				return err
+			}
+			// The CI has switched to the new rate, so can't be queried
+			fmt.Printf("Baud rate set to %d, reconnect with --baud %d\n", baud, baud)
+			return nil
+		case "flow", "crc":
+			var enable bool
+			switch args.Get(1) {
+			case "on":
+				if args.First() == "crc" {
+					return errors.New("CRC checksums aren't supported, and would leave the CI unreachable")
+				}
+				enable = true
+			case "off":
+			default:
+				return errors.Errorf("expected on or off, got '%s'", args.Get(1))
+			}
+			if args.First() == "flow" {
+				err = iface.SetRS232FlowControl(ctx, enable)
+			} else {
+				err = iface.SetRS232CRC(ctx, enable)
+			}
+		default:
+			return errors.Errorf("unknown setting '%s'", args.First())
+		}
+		if err != nil {
+			return err
+		}
+
+		config, err := iface.RS232Config(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Baud rate %d, flow control %v, CRC %v\n", config.Baud, config.FlowControl, config.CRC)
+		return nil
+	})
+}
+
+func monitorCommand(c *cli.Context) error {
+	return runCommand(c, monitorHandler{}, true, func(ctx context.Context, iface *xc.Interface) error {
+		log.Println("Monitoring, press Ctrl-C to stop")
+		<-ctx.Done()
+		return nil
+	})
+}
+
+func unknownCommand(c *cli.Context) error {
+	return runCommand(c, monitorHandler{}, true, func(ctx context.Context, iface *xc.Interface) error {
+		log.Println("Collecting unknown traffic, press Ctrl-C to stop")
+		<-ctx.Done()
+
+		data, err := json.MarshalIndent(iface.UnknownTraffic(), "", "  ")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fmt.Println(string(data))
+		return nil
+	})
+}
+
+// commandHandler ignores callbacks from the interface, for use when running
+// one-off commands.  Received messages are already logged by the interface.
+type commandHandler struct{}
+
+func (commandHandler) StatusValue(datapoint *xc.Datapoint, value int) {}
+
+func (commandHandler) StatusBool(datapoint *xc.Datapoint, on bool) {}
+
+func (commandHandler) StatusShutter(datapoint *xc.Datapoint, status xc.ShutterStatus) {}
+
+func (commandHandler) Event(datapoint *xc.Datapoint, event xc.Event) {}
+
+func (commandHandler) Wheel(datapoint *xc.Datapoint, value interface{}) {}
+
+func (commandHandler) Valve(datapoint *xc.Datapoint, position int) {}
+
+func (commandHandler) ValueEvent(datapoint *xc.Datapoint, event xc.Event, value interface{}) {}
+
+func (commandHandler) Value(datapoint *xc.Datapoint, value interface{}) {}
+
+func (commandHandler) Battery(device *xc.Device, percentage int) {}
+
+func (commandHandler) Power(device *xc.Device, value interface{}) {}
+
+func (commandHandler) InternalTemperature(device *xc.Device, centigrade int) {}
+
+func (commandHandler) Rssi(device *xc.Device, rssi int) {}
+
+func (commandHandler) DPLChanged(diff xc.DPLDiff) {
+	log.Printf("DPL changed: %s", diff)
+}
+
+func (commandHandler) SensorAssigned(number int) {}
+
+func (commandHandler) UnknownTraffic(entry xc.UnknownTraffic) {}
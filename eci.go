@@ -2,34 +2,252 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"encoding/binary"
 	"io"
 	"log"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/karloygard/xcomfortd-go/pkg/xc"
 
 	"github.com/pkg/errors"
 )
 
-const eciPort = 7153
+const (
+	eciPort = 7153
 
-func openEciDevices(ctx context.Context, hosts []string) (devices []io.ReadWriteCloser, err error) {
+	// Time allowed for connecting to and identifying an ECI
+	eciProbeTimeout = 2 * time.Second
+	// Number of addresses probed in parallel when scanning a subnet
+	eciScanParallel = 64
+	// Largest number of addresses scanned in a subnet
+	eciScanMaxHosts = 4096
+)
+
+type eciDevice struct {
+	address string
+	serial  uint32
+	device  io.ReadWriteCloser
+}
+
+// eciAddress adds the default ECI port to host, unless it has a port
+func eciAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(eciPort))
+}
+
+// openEciDevices connects to the ECIs listed in hosts, and to any ECIs
+// found by scanning subnets.  The ECIs are ordered by serial number, so
+// that the order doesn't change when their addresses do; ECIs in hosts
+// that couldn't be identified come last, in the order given.
+func openEciDevices(ctx context.Context, hosts, subnets []string) (devices []io.ReadWriteCloser, err error) {
+	var ecis []eciDevice
+
+	defer func() {
+		for i := range ecis {
+			devices = append(devices, ecis[i].device)
+		}
+	}()
+
+	connected := make(map[string]bool)
+
+	for i := range hosts {
+		address := eciAddress(hosts[i])
+
+		eci, openErr := openEciDevice(ctx, address, false)
+		if openErr != nil {
+			err = openErr
+			return
+		}
+
+		ecis = append(ecis, eci)
+		connected[address] = true
+	}
+
+	for i := range subnets {
+		found, scanErr := scanEciSubnet(ctx, subnets[i], connected)
+		ecis = append(ecis, found...)
+		if scanErr != nil {
+			err = scanErr
+			return
+		}
+	}
+
+	sort.SliceStable(ecis, func(i, j int) bool {
+		if ecis[i].serial == 0 || ecis[j].serial == 0 {
+			return ecis[j].serial == 0 && ecis[i].serial != 0
+		}
+		return ecis[i].serial < ecis[j].serial
+	})
+
+	return
+}
+
+// openEciDevice connects to the ECI at address, and asks for its serial
+// number.  If it doesn't answer, the connection fails if required is
+// set, such as when scanning; otherwise the ECI is used with serial 0.
+func openEciDevice(ctx context.Context, address string, required bool) (eciDevice, error) {
 	var dialer net.Dialer
+	if required {
+		dialer.Timeout = eciProbeTimeout
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return eciDevice{}, errors.WithStack(err)
+	}
+
+	device := xc.StartStopWrap(conn)
+
+	if err := conn.SetDeadline(time.Now().Add(eciProbeTimeout)); err != nil {
+		device.Close()
+		return eciDevice{}, errors.WithStack(err)
+	}
+	serial, err := xc.ProbeSerial(device)
+	if err != nil {
+		if required {
+			device.Close()
+			return eciDevice{}, errors.Wrapf(err, "identifying ECI (%s)", address)
+		}
+		log.Printf("Warning: couldn't identify ECI (%s), connecting anyway: %v", address, err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		device.Close()
+		return eciDevice{}, errors.WithStack(err)
+	}
+
+	if serial != 0 {
+		log.Printf("Connected to ECI (%s), serial %d", address, serial)
+	} else {
+		log.Printf("Connected to ECI (%s)", address)
+	}
+
+	return eciDevice{address, serial, device}, nil
+}
+
+// eciSubnetAddresses returns the ECI addresses in subnet, given in CIDR
+// notation, other than those already connected
+func eciSubnetAddresses(subnet string, connected map[string]bool) ([]string, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	base := ipnet.IP.To4()
+	if base == nil {
+		return nil, errors.Errorf("only IPv4 subnets can be scanned: %s", subnet)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 31 || 1<<(bits-ones) > eciScanMaxHosts {
+		return nil, errors.Errorf("subnet %s has more than %d addresses", subnet, eciScanMaxHosts)
+	}
+
+	var addresses []string
+	for n := uint32(0); n < 1<<(bits-ones); n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(base)+n)
+		address := net.JoinHostPort(ip.String(), strconv.Itoa(eciPort))
+		if !connected[address] {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses, nil
+}
+
+// scanEciSubnet connects to all ECIs found in subnet, given in CIDR
+// notation, other than those already connected
+func scanEciSubnet(ctx context.Context, subnet string, connected map[string]bool) ([]eciDevice, error) {
+	addresses, err := eciSubnetAddresses(subnet, connected)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Scanning %s for ECIs", subnet)
+
+	var (
+		m     sync.Mutex
+		found []eciDevice
+		wg    sync.WaitGroup
+	)
+	limit := make(chan struct{}, eciScanParallel)
+
+	for _, address := range addresses {
+		limit <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			if eci, err := openEciDevice(ctx, address, true); err == nil {
+				m.Lock()
+				found = append(found, eci)
+				m.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		for i := range found {
+			found[i].device.Close()
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	log.Printf("Found %d ECIs in %s", len(found), subnet)
+
+	return found, nil
+}
+
+// monitorDevice is a connection to the monitor port of a bridge, which
+// only receives what the CI sends.  The bridge doesn't read from monitor
+// clients, so frames written are discarded.
+type monitorDevice struct {
+	io.ReadWriteCloser
+	address string
+}
+
+func (m *monitorDevice) Write(p []byte) (int, error) {
+	log.Printf("Discarding frame to bridge monitor (%s), monitors can't send", m.address)
+	return len(p), nil
+}
+
+// openMonitorHosts connects to the monitor ports of the bridges listed in
+// hosts.  These can't be identified, so are kept in the order given.
+func openMonitorHosts(ctx context.Context, hosts []string) (devices []io.ReadWriteCloser, err error) {
+	dialer := net.Dialer{Timeout: eciProbeTimeout}
 
 	for i := range hosts {
-		var device io.ReadWriteCloser
-		hostPort := fmt.Sprintf("%s:%d", hosts[i], eciPort)
+		address := eciAddress(hosts[i])
 
-		if device, err = dialer.DialContext(ctx, "tcp", hostPort); err != nil {
-			err = errors.WithStack(err)
+		conn, dialErr := dialer.DialContext(ctx, "tcp", address)
+		if dialErr != nil {
+			err = errors.WithStack(dialErr)
 			return
 		}
 
-		log.Printf("Connected to ECI (%s)", hostPort)
+		log.Printf("Connected to bridge monitor (%s)", address)
 
-		devices = append(devices, xc.StartStopWrap(device))
+		devices = append(devices, &monitorDevice{xc.StartStopWrap(conn), address})
 	}
 
 	return
 }
+
+// isMonitor returns whether conn is a bridge monitor connection, which
+// can't be identified or set up
+func isMonitor(conn io.ReadWriter) bool {
+	_, ok := conn.(*monitorDevice)
+	return ok
+}
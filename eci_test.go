@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestEciAddress(t *testing.T) {
+	for host, want := range map[string]string{
+		"192.168.1.10":      "192.168.1.10:7153",
+		"192.168.1.10:1234": "192.168.1.10:1234",
+		"eci.local":         "eci.local:7153",
+		"eci.local:1234":    "eci.local:1234",
+		"fe80::1":           "[fe80::1]:7153",
+		"[fe80::1]":         "[fe80::1]:7153",
+		"[fe80::1]:1234":    "[fe80::1]:1234",
+	} {
+		if got := eciAddress(host); got != want {
+			t.Errorf("%s: got %s, expected %s", host, got, want)
+		}
+	}
+}
+
+func TestEciSubnetAddresses(t *testing.T) {
+	// The host part of the address is ignored
+	addresses, err := eciSubnetAddresses("192.168.1.77/30",
+		map[string]bool{"192.168.1.78:7153": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.168.1.76:7153", "192.168.1.77:7153", "192.168.1.79:7153"}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("/30: got %v, expected %v", addresses, want)
+	}
+
+	addresses, err = eciSubnetAddresses("10.0.5.0/24", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 256 {
+		t.Fatalf("/24: got %d addresses, expected 256", len(addresses))
+	}
+	for n, address := range addresses {
+		if want := fmt.Sprintf("10.0.5.%d:7153", n); address != want {
+			t.Fatalf("/24: got %s, expected %s", address, want)
+		}
+	}
+
+	for _, subnet := range []string{"10.0.0.0/16", "fe80::/120", "10.0.5.0"} {
+		if _, err := eciSubnetAddresses(subnet, nil); err == nil {
+			t.Errorf("%s accepted", subnet)
+		}
+	}
+}
+
+func TestOpenUnidentifiedEci(t *testing.T) {
+	// Accepts connections, but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	eci, err := openEciDevice(context.Background(), l.Addr().String(), false)
+	if err != nil {
+		t.Fatalf("explicit host: %v", err)
+	}
+	eci.device.Close()
+	if eci.serial != 0 {
+		t.Errorf("explicit host: serial %d, expected 0", eci.serial)
+	}
+
+	if _, err := openEciDevice(context.Background(), l.Addr().String(), true); err == nil {
+		t.Error("scanned host accepted without a serial number")
+	}
+}
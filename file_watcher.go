@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+)
+
+const fileWatchInterval = 10 * time.Second
+
+// watchFile reloads the datapoint file when it changes on disk, or when
+// SIGHUP is received.
+func watchFile(ctx context.Context, iface *xc.Interface, filename string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(fileWatchInterval)
+	defer ticker.Stop()
+
+	last, _ := os.Stat(filename)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hup:
+			log.Printf("SIGHUP received, reloading %s", filename)
+
+		case <-ticker.C:
+			info, err := os.Stat(filename)
+			if err != nil || (last != nil &&
+				info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+				continue
+			}
+			last = info
+			log.Printf("%s changed, reloading", filename)
+		}
+
+		if err := iface.ReloadFile(ctx, filename); err != nil {
+			log.Printf("Reloading %s failed: %v", filename, err)
+		}
+	}
+}
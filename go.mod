@@ -10,7 +10,7 @@ require (
 	github.com/karalabe/hid v1.0.0
 	github.com/pkg/errors v0.9.1
 	github.com/urfave/cli/v2 v2.27.7
-	golang.org/x/sync v0.17.0
+	golang.org/x/sys v0.37.0
 	golang.org/x/text v0.30.0
 )
 
@@ -20,4 +20,5 @@ require (
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20250705151800-55b8f293f342 // indirect
 	golang.org/x/net v0.46.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
 )
@@ -106,6 +106,28 @@ func (r *MqttRelay) HADiscoveryRemove() error {
 	return nil
 }
 
+// deviceBlock returns the device description shared by all entities
+// belonging to the device
+func deviceBlock(device *xc.Device) map[string]string {
+	block := map[string]string{
+		"identifiers":  fmt.Sprintf("%d", device.SerialNumber()),
+		"name":         device.Name(),
+		"manufacturer": "Eaton",
+		"model":        device.Type().String(),
+		"via_device":   "CI Stick",
+	}
+
+	if version := device.SoftwareVersion(); version != "" {
+		block["sw_version"] = version
+	}
+
+	if room := device.Location().Room; room != "" {
+		block["suggested_area"] = room
+	}
+
+	return block
+}
+
 func createDpDiscoveryMessages(discoveryPrefix, clientId string,
 	dp *xc.Datapoint, fn func(topic, addMsg, removeMsg string)) error {
 
@@ -120,14 +142,9 @@ func createDpDiscoveryMessages(discoveryPrefix, clientId string,
 	}
 
 	config := map[string]interface{}{
-		"unique_id": entityID,
-		"device": map[string]string{
-			"identifiers":  fmt.Sprintf("%d", dp.Device().SerialNumber()),
-			"name":         dp.Device().Name(),
-			"manufacturer": "Eaton",
-			"model":        dp.Device().Type().String(),
-			"via_device":   "CI Stick",
-		},
+		"unique_id":          entityID,
+		"device":             deviceBlock(dp.Device()),
+		"availability_topic": fmt.Sprintf("%s/status", clientId),
 	}
 
 	if dp.Name() != "" {
@@ -195,6 +212,7 @@ func createDpDiscoveryMessages(discoveryPrefix, clientId string,
 	case xc.PUSHBUTTON:
 		delete(config, "name")
 		delete(config, "unique_id")
+		delete(config, "availability_topic")
 
 		for i, a := range []map[xc.Event]string{
 			{
@@ -443,13 +461,8 @@ func createDeviceDiscoveryMessages(discoveryPrefix, clientId string,
 	deviceID := fmt.Sprintf("xcomfort_%d", device.SerialNumber())
 
 	config := map[string]interface{}{
-		"device": map[string]string{
-			"identifiers":  fmt.Sprintf("%d", device.SerialNumber()),
-			"name":         device.Name(),
-			"manufacturer": "Eaton",
-			"model":        device.Type().String(),
-			"via_device":   "CI Stick",
-		},
+		"device":             deviceBlock(device),
+		"availability_topic": fmt.Sprintf("%s/status", clientId),
 	}
 
 	config["state_class"] = "measurement"
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
@@ -31,7 +37,11 @@ func main() {
 			Name:    "file",
 			Aliases: []string{"f"},
 			EnvVars: []string{dpFilenameEnvVar},
-			Usage:   "Datapoint file exported from MRF software",
+			Usage:   "Datapoint file exported from MRF software, layered on top of the eprom with --eprom",
+		},
+		&cli.StringFlag{
+			Name:  "overrides",
+			Usage: "JSON file with datapoints to rename, add or ignore, applied on top of file and eprom",
 		},
 		&cli.StringFlag{
 			Name:    "client-id",
@@ -54,6 +64,10 @@ func main() {
 			Aliases: []string{"e"},
 			Usage:   "Read datapoints from eprom",
 		},
+		&cli.StringFlag{
+			Name:  "dpl-cache",
+			Usage: "Save datapoints read from eprom to this file, suffixed with the CI alias or serial number, and read them from it if the CI doesn't support reading the eprom",
+		},
 		&cli.BoolFlag{
 			Name:    "hadiscovery",
 			Aliases: []string{"hd"},
@@ -74,11 +88,51 @@ func main() {
 			Name:  "hidapi",
 			Usage: "Use hidapi for usb communication",
 		},
+		&cli.BoolFlag{
+			Name:  "publish-tx-result",
+			Usage: "Publish the acknowledgement, retries and latency of every command",
+		},
+		&cli.StringFlag{
+			Name:  "capture",
+			Usage: "Write all traffic to and from the CI to this file, as JSON lines",
+		},
+		&cli.StringFlag{
+			Name:  "replay",
+			Usage: "Replay traffic from a capture file instead of talking to a CI",
+		},
 		&cli.StringSliceFlag{
 			Name:  "host",
-			Usage: "Host names/IP addresses of ECI",
+			Usage: "Host names/IP addresses of ECI, optionally with port (default 7153)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "serial",
+			Usage: "Serial ports with RS232 CIs, e.g. /dev/ttyUSB0",
+		},
+		&cli.IntFlag{
+			Name:  "baud",
+			Value: 9600,
+			Usage: "Baud rate of the RS232 CIs, as configured on the CI",
+		},
+		&cli.BoolFlag{
+			Name:  "serial-flow",
+			Usage: "Use hardware flow control with the RS232 CIs",
+		},
+		&cli.DurationFlag{
+			Name:  "usb-rescan",
+			Usage: "Look for USB sticks plugged in or removed at this interval, e.g. 10s, rather than only at startup",
+		},
+		&cli.StringSliceFlag{
+			Name:  "eci-scan",
+			Usage: "Subnets to scan for ECIs, e.g. 192.168.1.0/24",
+		},
+		&cli.StringSliceFlag{
+			Name:  "monitor-host",
+			Usage: "Host names/IP addresses of bridge monitor ports, with port, which only receive what the CI sends",
 		},
 	}
+	app.Flags = append(app.Flags, retryFlags...)
+	app.Flags = append(app.Flags, identityFlags...)
+	app.Commands = append(commands, basicModeCommands...)
 	app.Action = openDevices
 
 	if err := app.Run(os.Args); err != nil {
@@ -87,12 +141,131 @@ func main() {
 }
 
 func openDevices(c *cli.Context) (err error) {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signalContext(context.Background())
+	defer cancel()
+
+	log.SetOutput(logRedacter{log.Writer()})
+
+	if c.Bool("verbose") {
+		log.Printf("Starting %s, version %s", c.App.Name, c.App.Version)
+	}
+
+	// Devices are kept open until all interfaces have stopped, so that
+	// outstanding commands can complete after a signal is received
+	devCtx, closeDevices := context.WithCancel(context.Background())
+
+	// USB sticks are opened as they're plugged in, if rescanning
+	rescan := c.Duration("usb-rescan")
+	hotplug := rescan > 0 && !c.Bool("hidapi") && c.String("replay") == ""
+
+	devices, done, err := openAllDevices(devCtx, c, !hotplug)
+	defer done()
+	// Deferred after done, so that reads on devCtx stop before the
+	// devices are closed
+	defer closeDevices()
+	if err != nil {
+		return err
+	}
+
+	if len(devices) == 0 && !hotplug {
+		log.Println("No devices found")
+		return nil
+	}
+
+	var (
+		wg  sync.WaitGroup
+		ids ciIds
+	)
+
+	// start runs a CI until it's removed or we're interrupted.  Hotplugged
+	// CIs are closed here, and captured if requested, while the others
+	// are handled by openAllDevices.
+	start := func(dev io.ReadWriteCloser, hotplugged bool) {
+		id := ids.get()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ids.put(id)
+
+			if hotplugged {
+				defer func() {
+					log.Printf("Closing CI %d", id)
+					dev.Close()
+				}()
+
+				if c.String("capture") != "" {
+					var err error
+					if dev, err = captureDevice(dev, c.String("capture"), id); err != nil {
+						log.Println(err)
+						cancel()
+						return
+					}
+				}
+			}
+
+			if err := run(ctx, dev, c, id); err != nil {
+				log.Println(err)
+				cancel()
+			}
+		}()
+	}
+
+	for i := range devices {
+		start(devices[i], false)
+	}
+
+	if hotplug {
+		watcher := newUsbWatcher()
+		defer watcher.Close()
+
+		log.Printf("Scanning for USB devices every %s", rescan)
+		watcher.Run(ctx, devCtx, rescan, func(dev io.ReadWriteCloser) {
+			start(dev, true)
+		})
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+// ciIds hands out the lowest id not in use, so that a CI that's unplugged
+// and plugged in again gets its id back
+type ciIds struct {
+	m     sync.Mutex
+	inUse []bool
+}
+
+func (c *ciIds) get() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for id := range c.inUse {
+		if !c.inUse[id] {
+			c.inUse[id] = true
+			return id
+		}
+	}
+	c.inUse = append(c.inUse, true)
+	return len(c.inUse) - 1
+}
+
+func (c *ciIds) put(id int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.inUse[id] = false
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM
+func signalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
 	go func() {
 		defer cancel()
 
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
 
 		select {
 		case <-sigs:
@@ -100,57 +273,130 @@ func openDevices(c *cli.Context) (err error) {
 		}
 	}()
 
-	log.SetOutput(logRedacter{log.Writer()})
+	return ctx, cancel
+}
 
-	if c.Bool("verbose") {
-		log.Printf("Starting %s, version %s", c.App.Name, c.App.Version)
+// openAllDevices opens all USB, HID, serial and ECI devices, as selected by the
+// command line flags, leaving out USB devices unless usb is set.  The
+// returned function closes the devices.
+func openAllDevices(ctx context.Context, c *cli.Context, usb bool) (devices []io.ReadWriteCloser, done func(), err error) {
+	usbDone := func() error { return nil }
+
+	done = func() {
+		for i := range devices {
+			devices[i].Close()
+		}
+		usbDone()
 	}
 
-	var devices []io.ReadWriteCloser
+	if c.String("replay") != "" {
+		var replay io.ReadWriteCloser
+		replay, err = openReplay(c.String("replay"))
+		if err == nil {
+			devices = append(devices, replay)
+		}
+		return
+	}
 
 	if c.Bool("hidapi") {
 		devices, err = openHidDevices()
-	} else {
-		var done func() error
-		devices, done, err = openUsbDevices(ctx)
-		defer done()
+	} else if usb {
+		devices, usbDone, err = openUsbDevices(ctx)
 	}
-	defer func() {
-		for i := range devices {
-			devices[i].Close()
-		}
-	}()
 	if err != nil {
-		return err
+		return
 	}
 
-	d, err := openEciDevices(ctx, c.StringSlice("host"))
+	d, err := openSerialDevices(c.StringSlice("serial"), c.Int("baud"), c.Bool("serial-flow"))
 	devices = append(devices, d...)
 	if err != nil {
-		return err
+		return
 	}
 
-	if len(devices) == 0 {
-		log.Println("No devices found")
-		return nil
+	d, err = openEciDevices(ctx, c.StringSlice("host"), c.StringSlice("eci-scan"))
+	devices = append(devices, d...)
+	if err != nil {
+		return
+	}
+
+	d, err = openMonitorHosts(ctx, c.StringSlice("monitor-host"))
+	devices = append(devices, d...)
+	if err != nil {
+		return
+	}
+
+	if c.String("capture") != "" {
+		err = captureDevices(devices, c.String("capture"))
 	}
 
-	var wg sync.WaitGroup
+	return
+}
+
+func openReplay(filename string) (*xc.Replay, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	log.Printf("Replaying %s", filename)
+
+	return xc.NewReplay(f)
+}
+
+// captureDevices wraps the devices so that their traffic is written to a
+// capture file per CI
+func captureDevices(devices []io.ReadWriteCloser, filename string) (err error) {
 	for i := range devices {
-		dev := devices[i]
-		wg.Add(1)
-		go func(id int) {
-			if err := run(ctx, dev, c, id); err != nil {
-				log.Println(err)
-				cancel()
-			}
-			wg.Done()
-		}(i)
+		if devices[i], err = captureDevice(devices[i], filename, i); err != nil {
+			return
+		}
 	}
 
-	wg.Wait()
+	return
+}
 
-	return nil
+func captureDevice(device io.ReadWriteCloser, filename string, id int) (io.ReadWriteCloser, error) {
+	if monitor, ok := device.(*monitorDevice); ok {
+		// Frames written to monitors are discarded, so aren't captured
+		var err error
+		monitor.ReadWriteCloser, err = captureDevice(monitor.ReadWriteCloser, filename, id)
+		return monitor, err
+	}
+
+	name := numberedFilename(filename, id)
+	f, err := os.Create(name)
+	if err != nil {
+		return device, err
+	}
+
+	log.Printf("Capturing CI %d traffic to %s", id, name)
+	return &capturedDevice{
+		ReadWriteCloser: xc.Capture(device, f),
+		filename:        filename,
+		name:            name,
+	}, nil
+}
+
+// capturedDevice is a CI whose traffic is captured to file.  The file is
+// named by CI id until the CI has been identified, as the ids depend on
+// the order the CIs were found in.
+type capturedDevice struct {
+	io.ReadWriteCloser
+	filename string
+	name     string
+}
+
+// identify renames the capture file after the CI's serial number or alias
+func (d *capturedDevice) identify(label string) {
+	name := labelledFilename(d.filename, label)
+	if err := os.Rename(d.name, name); err != nil {
+		log.Printf("Couldn't rename capture file: %v", err)
+		return
+	}
+
+	log.Printf("Capturing CI %s traffic to %s", label, name)
+	d.name = name
 }
 
 func run(ctx context.Context, conn io.ReadWriteCloser,
@@ -158,7 +404,22 @@ func run(ctx context.Context, conn io.ReadWriteCloser,
 
 	relay := &MqttRelay{}
 
-	relay.Init(relay, cliContext.Bool("verbose"))
+	// Callbacks are held back until the CI has been identified and the
+	// relay connected to MQTT
+	handler := &deferredHandler{}
+	relay.Init(handler, cliContext.Bool("verbose"))
+
+	policy, err := retryPolicy(cliContext)
+	if err != nil {
+		return err
+	}
+	relay.SetRetryPolicy(policy)
+
+	if cliContext.String("overrides") != "" {
+		if err := relay.ReadOverrides(cliContext.String("overrides")); err != nil {
+			return err
+		}
+	}
 
 	if cliContext.String("file") != "" {
 		if err := relay.ReadFile(cliContext.String("file")); err != nil {
@@ -171,59 +432,166 @@ func run(ctx context.Context, conn io.ReadWriteCloser,
 		return errors.WithStack(err)
 	}
 
+	relay.SetPublishTxResults(cliContext.Bool("publish-tx-result"))
+
 	if cliContext.Bool("hadiscovery") {
 		relay.SetupHADiscovery(cliContext.String("hadiscoveryprefix"),
 			cliContext.Bool("hadiscoveryremove"))
 	}
 
-	if err := relay.Connect(ctx, cliContext.String("client-id"), url, id); err != nil {
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- relay.Run(runCtx, conn)
+	}()
+
+	// stopRun stops the event loop, for when the CI can't be set up
+	stopRun := func(err error) error {
+		stop()
+		<-runErr
 		return err
 	}
-	defer relay.Close()
 
-	go func() {
-		// Some sanity checking
-		hwrev, rfrev, fwrev, err := relay.Revision()
-		if err != nil {
-			log.Fatalf("%+v", err)
-		}
-		log.Printf("CI HW/RF/FW revision: %d, %.1f, %d",
-			hwrev, float32(rfrev)/10, fwrev)
-		if rfrev < 90 {
-			log.Println("This software may not work well with RF Revision < 9.0")
+	// Bridge monitors only receive, so the CI can't be identified or set up
+	monitor := isMonitor(conn)
+
+	var serial uint32
+	if !monitor {
+		serial, err = relay.Serial(ctx)
+		if errors.Is(err, xc.ErrShuttingDown) || ctx.Err() != nil {
+			// The CI was removed, or we were interrupted, before it
+			// could be identified
+			return <-runErr
+		} else if err != nil {
+			return stopRun(err)
 		}
+		log.Printf("CI serial number: %d", serial)
+	}
 
-		rf, fw, err := relay.Release()
+	clientId, err := ciClientId(cliContext, serial, id)
+	if err != nil {
+		return stopRun(err)
+	}
+
+	if !monitor {
+		label, err := ciFileLabel(cliContext, serial)
 		if err != nil {
-			log.Fatalf("%+v", err)
+			return stopRun(err)
 		}
-		log.Printf("CI RF/Firmware release: %.2f, %.2f", rf, fw)
 
-		serial, err := relay.Serial()
-		if err != nil {
-			log.Fatalf("%+v", err)
+		if d, ok := conn.(*capturedDevice); ok {
+			d.identify(label)
 		}
-		log.Printf("CI serial number: %d", serial)
 
-		if err := relay.SetOKMRF(); err != nil {
-			log.Fatalf("%+v", err)
+		if cliContext.String("dpl-cache") != "" {
+			relay.SetDPLCache(labelledFilename(cliContext.String("dpl-cache"), label))
 		}
-		if err := relay.SetRfSeqNo(); err != nil {
-			log.Fatalf("%+v", err)
+	} else if cliContext.Bool("eprom") {
+		log.Printf("CI %d is a bridge monitor, so its eprom can't be read", id)
+	}
+
+	if err := relay.Connect(ctx, clientId, url); err != nil {
+		return stopRun(err)
+	}
+	defer relay.Close()
+
+	handler.start(relay)
+
+	if cliContext.String("file") != "" {
+		go watchFile(ctx, &relay.Interface, cliContext.String("file"))
+	}
+
+	go func() {
+		if !monitor && !setupCI(ctx, relay, cliContext.Bool("eprom")) {
+			return
 		}
 
-		if cliContext.Bool("eprom") {
-			if err := relay.RequestDPL(ctx); err != nil {
-				log.Fatalf("%+v", err)
-			}
+		if err := relay.PublishDatapointInfo(); err != nil {
+			log.Fatalf("%+v", err)
 		}
 
 		if err := relay.HADiscoveryAdd(); err != nil {
 			log.Fatalf("%+v", err)
 		}
+
+		// Only seeds the state of the datapoints, so done last, as not
+		// all CIs support it
+		if !monitor {
+			if err := relay.RequestSTL(ctx); err != nil {
+				log.Printf("Reading status list failed: %v", err)
+			}
+		}
 	}()
 
 	defer relay.HADiscoveryRemove()
 
-	return relay.Run(ctx, conn)
+	return <-runErr
+}
+
+// setupCI checks the CI revision and sets it up, returning false if this
+// failed
+func setupCI(ctx context.Context, relay *MqttRelay, eprom bool) bool {
+	// Some sanity checking
+	hwrev, rfrev, fwrev, err := relay.Revision(ctx)
+	if err != nil {
+		setupFailed(err)
+		return false
+	}
+	log.Printf("CI HW/RF/FW revision: %d, %.1f, %d",
+		hwrev, float32(rfrev)/10, fwrev)
+	if rfrev < 90 {
+		log.Println("This software may not work well with RF Revision < 9.0")
+	}
+
+	rf, fw, err := relay.Release(ctx)
+	if err != nil {
+		setupFailed(err)
+		return false
+	}
+	log.Printf("CI RF/Firmware release: %.2f, %.2f", rf, fw)
+
+	if err := relay.SetOKMRF(ctx); err != nil {
+		setupFailed(err)
+		return false
+	}
+	if err := relay.SetRfSeqNo(ctx); err != nil {
+		setupFailed(err)
+		return false
+	}
+
+	if eprom {
+		if err := relay.RequestDPL(ctx); err != nil {
+			setupFailed(err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// setupFailed exits, unless the CI was removed or we were interrupted
+// while setting it up
+func setupFailed(err error) {
+	if errors.Is(err, xc.ErrShuttingDown) || errors.Is(err, context.Canceled) {
+		log.Printf("Setup interrupted: %v", err)
+		return
+	}
+	log.Fatalf("%+v", err)
+}
+
+// numberedFilename inserts the CI id before the extension, so that each CI
+// gets its own file
+func numberedFilename(filename string, id int) string {
+	if id == 0 {
+		return filename
+	}
+	return labelledFilename(filename, strconv.Itoa(id))
+}
+
+// labelledFilename inserts label before the extension
+func labelledFilename(filename string, label string) string {
+	extension := filepath.Ext(filename)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(filename, extension), label, extension)
 }
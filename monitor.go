@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+)
+
+// monitorHandler logs the decoded values received from the interface
+type monitorHandler struct{}
+
+func (monitorHandler) StatusValue(datapoint *xc.Datapoint, value int) {
+	log.Printf("Datapoint %d: value %d", datapoint.Number(), value)
+}
+
+func (monitorHandler) StatusBool(datapoint *xc.Datapoint, on bool) {
+	log.Printf("Datapoint %d: switch %v", datapoint.Number(), on)
+}
+
+func (monitorHandler) StatusShutter(datapoint *xc.Datapoint, status xc.ShutterStatus) {
+	log.Printf("Datapoint %d: shutter %s", datapoint.Number(), status)
+}
+
+func (monitorHandler) Event(datapoint *xc.Datapoint, event xc.Event) {
+	log.Printf("Datapoint %d: event %s", datapoint.Number(), event)
+}
+
+func (monitorHandler) Wheel(datapoint *xc.Datapoint, value interface{}) {
+	log.Printf("Datapoint %d: wheel %v", datapoint.Number(), value)
+}
+
+func (monitorHandler) Valve(datapoint *xc.Datapoint, position int) {
+	log.Printf("Datapoint %d: valve %d%%", datapoint.Number(), position)
+}
+
+func (monitorHandler) ValueEvent(datapoint *xc.Datapoint, event xc.Event, value interface{}) {
+	log.Printf("Datapoint %d: event %s, value %v", datapoint.Number(), event, value)
+}
+
+func (monitorHandler) Value(datapoint *xc.Datapoint, value interface{}) {
+	log.Printf("Datapoint %d: value %v", datapoint.Number(), value)
+}
+
+func (monitorHandler) Battery(device *xc.Device, percentage int) {
+	log.Printf("Device %d: battery %d%%", device.SerialNumber(), percentage)
+}
+
+func (monitorHandler) Power(device *xc.Device, value interface{}) {
+	log.Printf("Device %d: power %vW", device.SerialNumber(), value)
+}
+
+func (monitorHandler) InternalTemperature(device *xc.Device, centigrade int) {
+	log.Printf("Device %d: internal temperature %dC", device.SerialNumber(), centigrade)
+}
+
+func (monitorHandler) Rssi(device *xc.Device, rssi int) {
+	log.Printf("Device %d: rssi %d", device.SerialNumber(), rssi)
+}
+
+func (monitorHandler) DPLChanged(diff xc.DPLDiff) {
+	log.Printf("DPL changed: %s", diff)
+}
+
+func (monitorHandler) SensorAssigned(number int) {
+	log.Printf("Sensor assigned to datapoint %d", number)
+}
+
+func (monitorHandler) UnknownTraffic(entry xc.UnknownTraffic) {
+	log.Printf("Unknown traffic: %s, device type %d (%s), subtype %d, event %d, data type %d, samples %v",
+		entry.Reason, entry.DeviceType, entry.DeviceName, entry.Subtype, entry.Event, entry.DataType, entry.Samples)
+}
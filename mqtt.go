@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
@@ -12,6 +13,7 @@ import (
 	"github.com/karloygard/xcomfortd-go/pkg/xc"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
 )
 
 type MqttRelay struct {
@@ -22,9 +24,34 @@ type MqttRelay struct {
 
 	haDiscoveryPrefix     *string
 	haDiscoveryAutoremove bool
+	publishTxResults      bool
 	clientId              string
 }
 
+// SetPublishTxResults enables publishing the outcome of every command
+func (r *MqttRelay) SetPublishTxResults(enable bool) {
+	r.publishTxResults = enable
+}
+
+func (r *MqttRelay) publishTxResult(datapoint *xc.Datapoint, result xc.TxResult) {
+	if !r.publishTxResults || result.Discarded {
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"ack":        result.Ack,
+		"dp_removed": result.DatapointRemoved,
+		"retries":    result.Retries,
+		"latency_ms": result.Latency.Milliseconds(),
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	r.publish(fmt.Sprintf("%s/%d/get/tx_result", r.clientId, datapoint.Number()), false, string(data))
+}
+
 func (r *MqttRelay) desiredTemperatureCallback(c mqtt.Client, msg mqtt.Message) {
 	var dp int
 	var value float32
@@ -41,12 +68,13 @@ func (r *MqttRelay) desiredTemperatureCallback(c mqtt.Client, msg mqtt.Message)
 	if datapoint := r.Datapoint(dp); datapoint != nil {
 		log.Printf("MQTT message; topic: '%s', message: '%s'\n", msg.Topic(), string(msg.Payload()))
 
-		if _, err := datapoint.DesiredTemperature(r.ctx, value); err != nil {
+		if result, err := datapoint.DesiredTemperature(r.ctx, value); err != nil {
 			log.Printf("WARNING: command for datapoint %d failed, state now unknown: %v", dp, err)
-		} /*else {
-			// Required?
-			r.Temperature(datapoint, value)
-		}*/
+		} else {
+			r.publishTxResult(datapoint, result)
+			/* Required?
+			r.Temperature(datapoint, value) */
+		}
 	} else {
 		log.Printf("unknown datapoint %d\n", dp)
 	}
@@ -68,9 +96,10 @@ func (r *MqttRelay) currentTemperatureCallback(c mqtt.Client, msg mqtt.Message)
 	if datapoint := r.Datapoint(dp); datapoint != nil {
 		log.Printf("MQTT message; topic: '%s', message: '%s'\n", msg.Topic(), string(msg.Payload()))
 
-		if _, err := datapoint.CurrentTemperature(r.ctx, value); err != nil {
+		if result, err := datapoint.CurrentTemperature(r.ctx, value); err != nil {
 			log.Printf("WARNING: command for datapoint %d failed, state now unknown: %v", dp, err)
 		} else {
+			r.publishTxResult(datapoint, result)
 			topic := fmt.Sprintf("%s/%d/get/current_temperature", r.clientId, datapoint.Number())
 			r.publish(topic, true, fmt.Sprint(value))
 		}
@@ -138,10 +167,14 @@ func (r *MqttRelay) dimmerCallback(c mqtt.Client, msg mqtt.Message) {
 	if datapoint := r.Datapoint(dp); datapoint != nil {
 		log.Printf("MQTT message; topic: '%s', message: '%s'\n", msg.Topic(), string(msg.Payload()))
 
-		if _, err := datapoint.Dim(r.ctx, value); err != nil {
+		if result, err := datapoint.Dim(r.ctx, value); err != nil {
 			log.Printf("WARNING: command for datapoint %d failed, state now unknown: %v", dp, err)
 		} else {
-			r.StatusValue(datapoint, value)
+			r.publishTxResult(datapoint, result)
+			// Without an acknowledgement, wait for the actuator to report
+			if result.Confirmed() {
+				r.StatusValue(datapoint, value)
+			}
 		}
 	} else {
 		log.Printf("unknown datapoint %d\n", dp)
@@ -161,10 +194,14 @@ func (r *MqttRelay) switchCallback(c mqtt.Client, msg mqtt.Message) {
 
 		on := string(msg.Payload()) == "true"
 
-		if _, err := datapoint.Switch(r.ctx, on); err != nil {
+		if result, err := datapoint.Switch(r.ctx, on); err != nil {
 			log.Printf("WARNING: command for datapoint %d failed, state now unknown: %v", dp, err)
 		} else {
-			r.StatusBool(datapoint, on)
+			r.publishTxResult(datapoint, result)
+			// Without an acknowledgement, wait for the actuator to report
+			if result.Confirmed() {
+				r.StatusBool(datapoint, on)
+			}
 		}
 	} else {
 		log.Printf("unknown datapoint %d\n", dp)
@@ -203,10 +240,14 @@ func (r *MqttRelay) shutterCallback(c mqtt.Client, msg mqtt.Message) {
 			return
 		}
 
-		if _, err := datapoint.Shutter(r.ctx, cmd); err != nil {
+		if result, err := datapoint.Shutter(r.ctx, cmd); err != nil {
 			log.Printf("WARNING: command for datapoint %d failed, state now unknown: %v", dp, err)
 		} else {
-			r.StatusShutter(datapoint, status)
+			r.publishTxResult(datapoint, result)
+			// Without an acknowledgement, wait for the actuator to report
+			if result.Confirmed() {
+				r.StatusShutter(datapoint, status)
+			}
 		}
 
 	} else {
@@ -214,6 +255,42 @@ func (r *MqttRelay) shutterCallback(c mqtt.Client, msg mqtt.Message) {
 	}
 }
 
+func (r *MqttRelay) learnModeCallback(c mqtt.Client, msg mqtt.Message) {
+	log.Printf("MQTT message; topic: '%s', message: '%s'\n", msg.Topic(), string(msg.Payload()))
+
+	on := string(msg.Payload()) == "true"
+
+	if err := r.LearnMode(r.ctx, on); err != nil {
+		log.Printf("WARNING: learn mode command failed: %v", err)
+	} else {
+		r.publish(fmt.Sprintf("%s/get/learnmode", r.clientId), true, fmt.Sprint(on))
+	}
+}
+
+func (r *MqttRelay) basicModeCallback(command string,
+	fn func(ctx context.Context, number int) error) mqtt.MessageHandler {
+
+	return func(c mqtt.Client, msg mqtt.Message) {
+		var dp int
+
+		if _, err := fmt.Sscanf(msg.Topic(), fmt.Sprintf("%s/%%d/set/%s", r.clientId, command), &dp); err != nil {
+			log.Println(err)
+			return
+		}
+
+		log.Printf("MQTT message; topic: '%s', message: '%s'\n", msg.Topic(), string(msg.Payload()))
+
+		result := "ok"
+		if err := fn(r.ctx, dp); err != nil {
+			log.Printf("WARNING: %s command for datapoint %d failed: %v", command, dp, err)
+			result = err.Error()
+		}
+
+		topic := fmt.Sprintf("%s/%d/get/%s", r.clientId, dp, command)
+		r.publish(topic, false, result)
+	}
+}
+
 func (r *MqttRelay) StatusValue(datapoint *xc.Datapoint, value int) {
 	topic := fmt.Sprintf("%s/%d/get/dimmer", r.clientId, datapoint.Number())
 	// If zero, only set false to prevent erasing last value
@@ -286,10 +363,82 @@ func (r *MqttRelay) InternalTemperature(device *xc.Device, temperature int) {
 	r.publish(topic, true, fmt.Sprint(temperature))
 }
 
-func (r *MqttRelay) DPLChanged() {
-	log.Printf("DPL Changed")
+func (r *MqttRelay) SensorAssigned(number int) {
+	topic := fmt.Sprintf("%s/event/sensor_assigned", r.clientId)
+	r.publish(topic, false, fmt.Sprint(number))
+}
+
+// UnknownTraffic publishes all traffic that couldn't be decoded so far,
+// retained, so that it can be collected when adding support for new devices
+func (r *MqttRelay) UnknownTraffic(entry xc.UnknownTraffic) {
+	log.Printf("Unknown traffic: %s, device type %d, event %d, data type %d",
+		entry.Reason, entry.DeviceType, entry.Event, entry.DataType)
 
-	err := r.HADiscoveryRemove()
+	data, err := json.Marshal(r.Interface.UnknownTraffic())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	r.publish(fmt.Sprintf("%s/unknown_traffic", r.clientId), true, string(data))
+}
+
+// PublishDatapointInfo publishes static information about devices and
+// datapoints, as read from the datapoint list.
+func (r *MqttRelay) PublishDatapointInfo() error {
+	if err := r.ForEachDevice(func(device *xc.Device) error {
+		if device.SoftwareVersion() != "" {
+			topic := fmt.Sprintf("%s/%d/sw_version", r.clientId, device.SerialNumber())
+			r.publish(topic, true, device.SoftwareVersion())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return r.ForEachDatapoint(func(dp *xc.Datapoint) error {
+		if dp.Location().IsZero() {
+			return nil
+		}
+
+		location, err := json.Marshal(dp.Location())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		topic := fmt.Sprintf("%s/%d/location", r.clientId, dp.Number())
+		r.publish(topic, true, string(location))
+		return nil
+	})
+}
+
+func (r *MqttRelay) DPLChanged(diff xc.DPLDiff) {
+	log.Printf("DPL Changed: %s", diff)
+
+	changes, err := json.Marshal(map[string][]int{
+		"added":   xc.DatapointNumbers(diff.Added),
+		"removed": xc.DatapointNumbers(diff.Removed),
+		"changed": xc.DatapointNumbers(diff.Changed),
+	})
+	if err != nil {
+		log.Println(err)
+	} else {
+		r.publish(fmt.Sprintf("%s/event/dpl_changed", r.clientId), false, string(changes))
+	}
+
+	if err := r.PublishDatapointInfo(); err != nil {
+		log.Println(err)
+	}
+
+	if r.haDiscoveryPrefix != nil && r.haDiscoveryAutoremove {
+		for _, dp := range diff.Removed {
+			if err := createDpDiscoveryMessages(*r.haDiscoveryPrefix, r.clientId, dp, r.removeDevice); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	err = r.HADiscoveryRemove()
 	if err == nil {
 		err = r.HADiscoveryAdd()
 	}
@@ -299,15 +448,11 @@ func (r *MqttRelay) DPLChanged() {
 	}
 }
 
-func (r *MqttRelay) Connect(ctx context.Context, clientId string, uri *url.URL, id int) error {
+func (r *MqttRelay) Connect(ctx context.Context, clientId string, uri *url.URL) error {
 	opts := mqtt.NewClientOptions()
 	broker := fmt.Sprintf("tcp://%s", uri.Host)
 
-	if id > 0 {
-		r.clientId = fmt.Sprintf("%s-%d", clientId, id)
-	} else {
-		r.clientId = clientId
-	}
+	r.clientId = clientId
 	log.Printf("Connecting to MQTT broker '%s' with id '%s'", broker, r.clientId)
 
 	mqtt.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
@@ -319,7 +464,8 @@ func (r *MqttRelay) Connect(ctx context.Context, clientId string, uri *url.URL,
 		SetConnectRetry(true).
 		SetOnConnectHandler(r.connected).
 		SetConnectionLostHandler(r.connectionLost).
-		SetKeepAlive(30 * time.Second).
+		SetKeepAlive(30*time.Second).
+		SetWill(r.availabilityTopic(), "offline", 1, true).
 		SetUsername(uri.User.Username())
 	if password, set := uri.User.Password(); set {
 		opts.SetPassword(password)
@@ -339,10 +485,16 @@ func (r *MqttRelay) Connect(ctx context.Context, clientId string, uri *url.URL,
 	return nil
 }
 
+// Close publishes offline availability and disconnects from the broker
 func (r *MqttRelay) Close() {
+	r.client.Publish(r.availabilityTopic(), 1, true, "offline").WaitTimeout(time.Second)
 	r.client.Disconnect(1000)
 }
 
+func (r *MqttRelay) availabilityTopic() string {
+	return fmt.Sprintf("%s/status", r.clientId)
+}
+
 func (r *MqttRelay) connected(c mqtt.Client) {
 	subscriptions := map[string]func(c mqtt.Client, m mqtt.Message){
 		"dimmer":                    r.dimmerCallback,
@@ -352,6 +504,9 @@ func (r *MqttRelay) connected(c mqtt.Client) {
 		"current_temperature":       r.currentTemperatureCallback,
 		"async_temperature":         r.asyncDesiredTemperatureCallback,
 		"async_current_temperature": r.asyncCurrentTemperatureCallback,
+		"assign":                    r.basicModeCallback("assign", r.AssignActuator),
+		"remove_actuator":           r.basicModeCallback("remove_actuator", r.RemoveActuator),
+		"remove_sensor":             r.basicModeCallback("remove_sensor", r.RemoveSensor),
 	}
 
 	for k, c := range subscriptions {
@@ -360,11 +515,16 @@ func (r *MqttRelay) connected(c mqtt.Client) {
 			func(c mqtt.Client, m mqtt.Message) { go cb(c, m) })
 	}
 
+	r.subscribe(fmt.Sprintf("%s/set/learnmode", r.clientId),
+		func(c mqtt.Client, m mqtt.Message) { go r.learnModeCallback(c, m) })
+
 	if r.haDiscoveryPrefix != nil {
 		r.client.Subscribe(*r.haDiscoveryPrefix+"/status", 0,
 			func(c mqtt.Client, m mqtt.Message) { go r.hassStatusCallback(m) })
 	}
 
+	r.publish(r.availabilityTopic(), true, "online")
+
 	log.Println("Connected to broker")
 }
 
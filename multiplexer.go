@@ -0,0 +1,333 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+)
+
+const (
+	// Time after which a TX command is assumed lost, if the CI hasn't
+	// responded, and its sequence number reused
+	muxTxTimeout = 30 * time.Second
+	// Time after which a CONFIG or EXTENDED request is assumed lost, if
+	// the CI hasn't responded, and the next request is sent
+	muxResponseTimeout = 5 * time.Second
+)
+
+type muxTx struct {
+	client *bridgeClient
+	seq    byte
+	sent   time.Time
+}
+
+// multiplexer lets several clients share one CI.  TX commands are given
+// sequence numbers that are unique across all clients, and the statuses
+// for them are returned to the sender with its own sequence number.
+// CONFIG and EXTENDED requests are sent one at a time, since the CI
+// doesn't tell which request a response is for, and the responses are
+// returned to the sender.  Everything else the CI sends goes to all
+// clients.
+type multiplexer struct {
+	m    sync.Mutex
+	cond *sync.Cond
+	txs  [16]*muxTx
+	next byte
+
+	config   muxSlot
+	extended muxSlot
+}
+
+func newMultiplexer() *multiplexer {
+	mux := &multiplexer{
+		config:   newMuxSlot("CONFIG"),
+		extended: newMuxSlot("EXTENDED"),
+	}
+	mux.cond = sync.NewCond(&mux.m)
+	return mux
+}
+
+// toCI prepares a frame from a client for the CI, waiting until it can be
+// sent.  Frames include the length byte.
+func (mux *multiplexer) toCI(client *bridgeClient, frame []byte) ([]byte, error) {
+	packet, err := mci.Unmarshal(frame[1:])
+	if err != nil {
+		// Pass on as is, and let the CI complain
+		return frame, nil
+	}
+
+	switch p := packet.(type) {
+	case mci.TX:
+		p.Seq = mux.allocate(client, p.Seq)
+		out, err := mci.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{byte(len(out) + 1)}, out...), nil
+
+	case mci.Config:
+		mux.config.acquire(client, p)
+
+	case mci.Extended:
+		mux.extended.acquire(client, p)
+	}
+
+	return frame, nil
+}
+
+// fromCI returns the client a frame from the CI is for, or nil if it's
+// for all clients, and the frame to pass on, or nil if it should be
+// dropped
+func (mux *multiplexer) fromCI(frame []byte) (*bridgeClient, []byte) {
+	packet, err := mci.Unmarshal(frame[1:])
+	if err != nil {
+		return nil, frame
+	}
+
+	switch p := packet.(type) {
+	case mci.Status:
+		code, _ := p.Code()
+
+		// Errors carry what looks like a sequence number, also when
+		// they're for a CONFIG or EXTENDED request, so check for those
+		// first.  General errors are also sent for TX commands, so are
+		// only taken as a CONFIG response if no TX has that number.
+		if p.Status == xc.MCI_STT_ERROR {
+			seq, _ := p.Seq()
+			switch {
+			case code == xc.MCI_STS_UNKNOWN && mux.extended.isHeld():
+				return mux.extended.respond(frame)
+			case code == xc.MCI_STS_GENERAL && mux.config.isHeld() && !mux.tracked(seq):
+				return mux.config.respond(frame)
+			}
+		}
+
+		if seq, ok := p.Seq(); ok {
+			if tx := mux.release(seq); tx != nil {
+				if tx.client == nil {
+					// The client has disconnected
+					return nil, nil
+				}
+				out, err := mci.Marshal(p.WithSeq(tx.seq))
+				if err != nil {
+					return nil, frame
+				}
+				return tx.client, append([]byte{byte(len(out) + 1)}, out...)
+			}
+			if p.Status == xc.MGW_STT_OK {
+				// OK_MRF for a TX command that timed out, whose
+				// sender can't be known
+				log.Printf("Dropping status for untracked TX sequence number %d", seq)
+				return nil, nil
+			}
+			// Otherwise an error for a request that has timed out
+		}
+
+		request, held := mux.config.outstanding().(mci.Config)
+		switch {
+		case p.Status == xc.MCI_STT_ERROR && code == xc.MCI_STS_UNKNOWN:
+			return mux.extended.respond(frame)
+		case held && isConfigResponse(request, p):
+			return mux.config.respond(frame)
+		}
+		// Otherwise sent by the CI unasked, such as timeaccount
+		// updates, so for all clients
+
+	case mci.Extended:
+		switch p.Command {
+		case xc.MCI_ET_REPLY, xc.MCI_ET_SEND_DPL, xc.MCI_ET_SEND_STL:
+			return mux.extended.respond(frame)
+		}
+	}
+
+	return nil, frame
+}
+
+// isConfigResponse returns whether status is the response to the CONFIG
+// request.  Settings are read back in a status with the number of the
+// command, while changing them is acknowledged with OK_CONFIG or that
+// status.
+func isConfigResponse(request mci.Config, status mci.Status) bool {
+	code, _ := status.Code()
+
+	read := len(request.Data) > 0 &&
+		(request.Data[0] == xc.CF_DATA_GET ||
+			request.Command == xc.CONF_RELEASE && request.Data[0] == xc.CF_DATA_GET_REVISION)
+
+	switch status.Status {
+	case xc.MGW_STT_OK:
+		return code == xc.STATUS_OK_CONFIG && !read
+	case xc.MCI_STT_TIMEACCOUNT:
+		return request.Command == xc.CONF_TIMEACCOUNT && code == xc.STATUS_DATA
+	case xc.MGW_STT_SEND_OK_MRF:
+		return request.Command == xc.CONF_SEND_OK_MRF
+	default:
+		return status.Status == request.Command
+	}
+}
+
+// allocate returns a sequence number for a TX command from client, waiting
+// if all are in use
+func (mux *multiplexer) allocate(client *bridgeClient, seq byte) byte {
+	mux.m.Lock()
+	defer mux.m.Unlock()
+
+	for {
+		for range mux.txs {
+			mux.next = (mux.next + 1) % byte(len(mux.txs))
+
+			tx := mux.txs[mux.next]
+			if tx != nil && time.Since(tx.sent) > muxTxTimeout {
+				log.Printf("No status for TX with sequence number %d, reusing it", mux.next)
+				tx = nil
+			}
+			if tx == nil {
+				mux.txs[mux.next] = &muxTx{client, seq, time.Now()}
+				return mux.next
+			}
+		}
+
+		// Woken when a sequence number is released
+		timer := time.AfterFunc(muxTxTimeout, mux.cond.Broadcast)
+		mux.cond.Wait()
+		timer.Stop()
+	}
+}
+
+// tracked returns whether a TX command is outstanding with sequence number
+// seq
+func (mux *multiplexer) tracked(seq byte) bool {
+	mux.m.Lock()
+	defer mux.m.Unlock()
+
+	return mux.txs[seq] != nil
+}
+
+// release frees a sequence number, and returns the TX command it was used
+// for, if any
+func (mux *multiplexer) release(seq byte) *muxTx {
+	mux.m.Lock()
+	defer mux.m.Unlock()
+
+	tx := mux.txs[seq]
+	mux.txs[seq] = nil
+	mux.cond.Broadcast()
+
+	return tx
+}
+
+// forget drops the TX commands of a client that has disconnected
+func (mux *multiplexer) forget(client *bridgeClient) {
+	mux.m.Lock()
+	defer mux.m.Unlock()
+
+	for i := range mux.txs {
+		if mux.txs[i] != nil && mux.txs[i].client == client {
+			// Keep the sequence number reserved until the status
+			// arrives, but don't pass it on
+			mux.txs[i].client = nil
+		}
+	}
+
+	mux.config.forget(client)
+	mux.extended.forget(client)
+}
+
+// muxSlot lets one request of a kind be outstanding at a time.  The slot
+// is released when the response arrives, or after a timeout.
+type muxSlot struct {
+	kind string
+	sem  chan struct{}
+
+	m     sync.Mutex
+	held  bool
+	token int
+	// The outstanding request
+	request mci.Packet
+	// The client that sent the outstanding request, nil if it has
+	// disconnected
+	client *bridgeClient
+}
+
+func newMuxSlot(kind string) muxSlot {
+	return muxSlot{kind: kind, sem: make(chan struct{}, 1)}
+}
+
+func (s *muxSlot) acquire(client *bridgeClient, request mci.Packet) {
+	s.sem <- struct{}{}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.held = true
+	s.client = client
+	s.request = request
+	s.token++
+	token := s.token
+	time.AfterFunc(muxResponseTimeout, func() {
+		s.m.Lock()
+		defer s.m.Unlock()
+
+		if s.held && s.token == token {
+			log.Printf("No response to %s request, sending the next", s.kind)
+			s.held = false
+			s.client = nil
+			<-s.sem
+		}
+	})
+}
+
+// isHeld returns whether a request is outstanding
+func (s *muxSlot) isHeld() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.held
+}
+
+// outstanding returns the outstanding request, or nil if there is none
+func (s *muxSlot) outstanding() mci.Packet {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.held {
+		return nil
+	}
+	return s.request
+}
+
+// respond releases the slot on a response from the CI, and returns the
+// client to pass it on to, like fromCI.  Responses to requests from
+// clients that have disconnected are dropped, while responses when no
+// request is outstanding go to all clients.
+func (s *muxSlot) respond(frame []byte) (*bridgeClient, []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.held {
+		return nil, frame
+	}
+
+	client := s.client
+	s.held = false
+	s.client = nil
+	<-s.sem
+
+	if client == nil {
+		return nil, nil
+	}
+	return client, frame
+}
+
+// forget drops the outstanding request of a client that has disconnected
+func (s *muxSlot) forget(client *bridgeClient) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.client == client {
+		s.client = nil
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+)
+
+// muxFrame returns p as a frame, with the length byte
+func muxFrame(t *testing.T, p mci.Packet) []byte {
+	out, err := mci.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{byte(len(out) + 1)}, out...)
+}
+
+func muxTX(seq byte) mci.Packet {
+	return mci.TX{Datapoint: 1, Event: xc.MCI_TE_SWITCH, Data: []byte{0x01}, Seq: seq}
+}
+
+func muxOKMRF(seq byte) mci.Packet {
+	return mci.Status{Status: xc.MGW_STT_OK, Data: []byte{xc.STATUS_OK_MRF, seq << 4, xc.STATUS_DATA_OKMRF_ACK}}
+}
+
+func muxError(code, seq byte) mci.Packet {
+	if code == xc.MCI_STS_GENERAL {
+		return mci.Status{Status: xc.MCI_STT_ERROR, Data: []byte{code, xc.ERR_T_RS232_CRC, seq << 4}}
+	}
+	return mci.Status{Status: xc.MCI_STT_ERROR, Data: []byte{code, seq << 4}}
+}
+
+// muxStep passes a frame through the multiplexer: from client to the CI,
+// or from the CI if client is nil, in which case it's expected to go to
+// to, or to all clients if to is nil.  A nil packet disconnects client.
+type muxStep struct {
+	client *bridgeClient
+	packet mci.Packet
+	to     *bridgeClient
+	want   mci.Packet
+}
+
+func TestMultiplexer(t *testing.T) {
+	a := &bridgeClient{name: "a"}
+	b := &bridgeClient{name: "b"}
+
+	serial := mci.Config{Command: xc.CONF_SERIAL, Data: []byte{xc.CF_DATA_GET}}
+	serialStatus := mci.Status{Status: xc.MGW_STT_SERIAL, Data: []byte{0x00, 0x12, 0x34, 0x56}}
+	getTimeaccount := mci.Config{Command: xc.CONF_TIMEACCOUNT, Data: []byte{xc.CF_DATA_GET}}
+	timeaccount := mci.Status{Status: xc.MCI_STT_TIMEACCOUNT, Data: []byte{xc.STATUS_DATA, 80}}
+	setOKMRF := mci.Config{Command: xc.CONF_SEND_OK_MRF, Data: []byte{xc.CF_DATA_SET}}
+	configOK := mci.Status{Status: xc.MGW_STT_OK, Data: []byte{xc.STATUS_OK_CONFIG}}
+	readDPL := mci.Extended{Command: xc.MCI_ET_REQU_DPL, Data: []byte{0x00, 0x00}}
+	dplChanged := mci.Extended{Command: xc.MCI_ET_DPL_CHANGED}
+
+	tests := []struct {
+		name  string
+		steps []muxStep
+	}{
+		{
+			name: "sequence numbers rewritten",
+			steps: []muxStep{
+				{client: a, packet: muxTX(3), want: muxTX(1)},
+				{client: b, packet: muxTX(3), want: muxTX(2)},
+				{packet: muxOKMRF(2), to: b, want: muxOKMRF(3)},
+				{packet: muxError(xc.MCI_STS_NO_ACK, 1), to: a, want: muxError(xc.MCI_STS_NO_ACK, 3)},
+			},
+		},
+		{
+			name: "client disconnected",
+			steps: []muxStep{
+				{client: a, packet: muxTX(3), want: muxTX(1)},
+				{client: b, packet: serial, want: serial},
+				{client: a},
+				{client: b},
+				{packet: muxOKMRF(1)},
+				{packet: serialStatus},
+			},
+		},
+		{
+			name: "late OK_MRF",
+			steps: []muxStep{
+				{packet: muxOKMRF(5)},
+				// The sequence number is free, so is reused
+				{client: a, packet: muxTX(0), want: muxTX(1)},
+				{packet: muxOKMRF(1), to: a, want: muxOKMRF(0)},
+				{packet: muxOKMRF(1)},
+			},
+		},
+		{
+			name: "CONFIG error while TX outstanding",
+			steps: []muxStep{
+				{client: a, packet: muxTX(7), want: muxTX(1)},
+				{client: b, packet: serial, want: serial},
+				{packet: muxError(xc.MCI_STS_GENERAL, 0), to: b, want: muxError(xc.MCI_STS_GENERAL, 0)},
+				{packet: muxOKMRF(1), to: a, want: muxOKMRF(7)},
+			},
+		},
+		{
+			name: "TX error while CONFIG outstanding",
+			steps: []muxStep{
+				{client: a, packet: muxTX(7), want: muxTX(1)},
+				{client: b, packet: serial, want: serial},
+				{packet: muxError(xc.MCI_STS_GENERAL, 1), to: a, want: muxError(xc.MCI_STS_GENERAL, 7)},
+				{packet: serialStatus, to: b, want: serialStatus},
+			},
+		},
+		{
+			name: "unsolicited statuses while CONFIG outstanding",
+			steps: []muxStep{
+				{client: a, packet: serial, want: serial},
+				{packet: timeaccount, want: timeaccount},
+				{packet: configOK, want: configOK},
+				{packet: serialStatus, to: a, want: serialStatus},
+				{client: b, packet: getTimeaccount, want: getTimeaccount},
+				{packet: serialStatus, want: serialStatus},
+				{packet: timeaccount, to: b, want: timeaccount},
+				{client: a, packet: setOKMRF, want: setOKMRF},
+				{packet: configOK, to: a, want: configOK},
+			},
+		},
+		{
+			name: "EXTENDED error while TX outstanding",
+			steps: []muxStep{
+				{client: a, packet: muxTX(7), want: muxTX(1)},
+				{client: b, packet: readDPL, want: readDPL},
+				{packet: muxError(xc.MCI_STS_UNKNOWN, 1), to: b, want: muxError(xc.MCI_STS_UNKNOWN, 1)},
+				{packet: muxError(xc.MCI_STS_GENERAL, 1), to: a, want: muxError(xc.MCI_STS_GENERAL, 7)},
+			},
+		},
+		{
+			name: "responses",
+			steps: []muxStep{
+				{client: a, packet: serial, want: serial},
+				{packet: serialStatus, to: a, want: serialStatus},
+				{client: b, packet: readDPL, want: readDPL},
+				{packet: dplChanged, want: dplChanged},
+				{packet: mci.Extended{Command: xc.MCI_ET_SEND_DPL}, to: b, want: mci.Extended{Command: xc.MCI_ET_SEND_DPL}},
+				// Nothing outstanding, so for all clients
+				{packet: serialStatus, want: serialStatus},
+				{packet: muxError(xc.MCI_STS_GENERAL, 4), want: muxError(xc.MCI_STS_GENERAL, 4)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mux := newMultiplexer()
+
+			for n, step := range test.steps {
+				var want []byte
+				if step.want != nil {
+					want = muxFrame(t, step.want)
+				}
+
+				switch {
+				case step.packet == nil:
+					mux.forget(step.client)
+
+				case step.client != nil:
+					out, err := mux.toCI(step.client, muxFrame(t, step.packet))
+					if err != nil {
+						t.Fatalf("step %d: %v", n, err)
+					}
+					if !bytes.Equal(out, want) {
+						t.Fatalf("step %d: sent %x to CI, expected %x", n, out, want)
+					}
+
+				default:
+					to, out := mux.fromCI(muxFrame(t, step.packet))
+					if to != step.to {
+						t.Fatalf("step %d: passed on to %v, expected %v", n, to, step.to)
+					}
+					if !bytes.Equal(out, want) {
+						t.Fatalf("step %d: passed on %x, expected %x", n, out, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Package mci encodes and decodes the packets exchanged with xComfort
+// communication interfaces (CI).  Frames are handled without the leading
+// length byte and any start/stop bytes, which belong to the transport.
+package mci
+
+import (
+	"github.com/pkg/errors"
+)
+
+// PacketType is the first byte of every frame
+type PacketType byte
+
+const (
+	PacketTX       PacketType = 0xB1
+	PacketConfig   PacketType = 0xB2
+	PacketRX       PacketType = 0xC1
+	PacketStatus   PacketType = 0xC3
+	PacketExtended PacketType = 0xD1
+)
+
+var (
+	ErrShortFrame        = errors.New("mci: frame too short")
+	ErrUnknownPacketType = errors.New("mci: unknown packet type")
+	ErrInvalidField      = errors.New("mci: invalid field")
+)
+
+// Packet is implemented by all packet types
+type Packet interface {
+	Type() PacketType
+}
+
+// TX sends an event to a datapoint
+type TX struct {
+	Datapoint byte
+	Event     byte
+	Data      []byte
+	// Sequence number, 0-15, returned in the STATUS for this TX
+	Seq byte
+}
+
+func (TX) Type() PacketType { return PacketTX }
+
+// Config reads or changes a setting of the CI
+type Config struct {
+	Command byte
+	Data    []byte
+}
+
+func (Config) Type() PacketType { return PacketConfig }
+
+// Extended reads from the CI eprom, or is a reply or notification from it
+type Extended struct {
+	Command byte
+	Data    []byte
+}
+
+func (Extended) Type() PacketType { return PacketExtended }
+
+// Block returns the address and data of a reply from the eprom
+func (e Extended) Block() (address uint32, data []byte, err error) {
+	if len(e.Data) < 6 {
+		return 0, nil, errors.Wrapf(ErrShortFrame, "eprom reply is %d bytes", len(e.Data))
+	}
+	address = uint32(e.Data[0]) | uint32(e.Data[1])<<8 | uint32(e.Data[2])<<16 | uint32(e.Data[3])<<24
+	return address, e.Data[6:], nil
+}
+
+// Marshal encodes a packet as a frame
+func Marshal(p Packet) ([]byte, error) {
+	switch p := p.(type) {
+	case TX:
+		if p.Seq > 0xf {
+			return nil, errors.Wrapf(ErrInvalidField, "sequence number %d", p.Seq)
+		}
+		frame := append([]byte{byte(PacketTX), p.Datapoint, p.Event}, p.Data...)
+		return append(frame, p.Seq<<4), nil
+	case Config:
+		return append([]byte{byte(PacketConfig), p.Command}, p.Data...), nil
+	case Extended:
+		return append([]byte{byte(PacketExtended), p.Command}, p.Data...), nil
+	case Status:
+		return append([]byte{byte(PacketStatus), p.Status}, p.Data...), nil
+	case RX:
+		return append([]byte{byte(PacketRX)}, p.marshal()...), nil
+	case ExtendedStatus:
+		return append([]byte{byte(PacketRX)}, p.marshal()...), nil
+	case BasicMode:
+		return append([]byte{byte(PacketRX)}, p.marshal()...), nil
+	default:
+		return nil, errors.WithStack(ErrUnknownPacketType)
+	}
+}
+
+// Unmarshal decodes a frame.  RX frames are decoded as RX, ExtendedStatus
+// or BasicMode, depending on the event.
+func Unmarshal(frame []byte) (Packet, error) {
+	if len(frame) < 2 {
+		return nil, errors.Wrapf(ErrShortFrame, "frame is %d bytes", len(frame))
+	}
+
+	data := frame[1:]
+	switch PacketType(frame[0]) {
+	case PacketTX:
+		if len(data) < 3 {
+			return nil, errors.Wrapf(ErrShortFrame, "TX is %d bytes", len(data))
+		}
+		return TX{
+			Datapoint: data[0],
+			Event:     data[1],
+			Data:      data[2 : len(data)-1],
+			Seq:       data[len(data)-1] >> 4,
+		}, nil
+	case PacketConfig:
+		return Config{Command: data[0], Data: data[1:]}, nil
+	case PacketExtended:
+		return Extended{Command: data[0], Data: data[1:]}, nil
+	case PacketStatus:
+		return Status{Status: data[0], Data: data[1:]}, nil
+	case PacketRX:
+		return UnmarshalRX(data)
+	default:
+		return nil, errors.Wrapf(ErrUnknownPacketType, "packet type %02x", frame[0])
+	}
+}
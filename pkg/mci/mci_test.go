@@ -0,0 +1,110 @@
+package mci
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// RX from a room controller on datapoint 11, reporting 23.0C with the
+// wheel at +2.0
+var rcFrame = []byte{0xC1, 0x0B, 0x62, 0x17, 0x00, 0x00, 0xE6, 0x00, 0x14, 0x48, 0x10}
+
+func TestRXRoundTrip(t *testing.T) {
+	packet, err := Unmarshal(rcFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := RX{
+		Datapoint: 0x0B,
+		Event:     0x62,
+		DataType:  0x17,
+		InfoShort: 0x00,
+		Value:     [4]byte{0x00, 0xE6, 0x00, 0x14},
+		RSSI:      0x48,
+		Battery:   0x10,
+	}
+	if !reflect.DeepEqual(packet, expected) {
+		t.Fatalf("decoded %+v, expected %+v", packet, expected)
+	}
+
+	frame, err := Marshal(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, rcFrame) {
+		t.Fatalf("encoded [% x], expected [% x]", frame, rcFrame)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	frames := [][]byte{
+		// TX switching datapoint 3 on, sequence number 5
+		{0xB1, 0x03, 0x0A, 0x00, 0x50},
+		// CONFIG reading the serial number
+		{0xB2, 0x0E, 0x00},
+		// EXTENDED reading the eprom
+		{0xD1, 0x10, 0x00, 0x00, 0x00, 0x00, 0x20},
+		// STATUS OK_MRF for sequence number 5
+		{0xC3, 0x1C, 0x04, 0x50},
+		// Extended status from a heating actuator
+		{0xC1, 0x00, 0x73, 0x39, 0x00, 0x78, 0x56, 0x34, 0x12, 0x1C, 0x01, 0x33},
+		// Sensor assigned in learn mode
+		{0xC1, 0x04, 0x80, 0x01, 0x02},
+	}
+
+	for _, frame := range frames {
+		packet, err := Unmarshal(frame)
+		if err != nil {
+			t.Errorf("[% x]: %v", frame, err)
+			continue
+		}
+		out, err := Marshal(packet)
+		if err != nil {
+			t.Errorf("[% x]: %v", frame, err)
+			continue
+		}
+		if !bytes.Equal(out, frame) {
+			t.Errorf("[% x] encoded as [% x]", frame, out)
+		}
+	}
+}
+
+func TestShortRX(t *testing.T) {
+	for n := 0; n < len(rcFrame); n++ {
+		_, err := Unmarshal(rcFrame[:n])
+		if !errors.Is(err, ErrShortFrame) {
+			t.Errorf("%d bytes: got %v, expected ErrShortFrame", n, err)
+		}
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	f.Add(rcFrame)
+	f.Add([]byte{0xB1, 0x03, 0x0A, 0x00, 0x50})
+	f.Add([]byte{0xC3, 0x09, 0x00, 0x00, 0x30})
+	f.Add([]byte{0xC1, 0x00, 0x73, 0x39, 0x00, 0x78, 0x56, 0x34, 0x12, 0x1C, 0x01, 0x33})
+	f.Add([]byte{0xD1, 0x11, 0x00, 0x00, 0x00, 0x00, 0x0A, 0x00, 0x02})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		packet, err := Unmarshal(frame)
+		if err != nil {
+			return
+		}
+
+		out, err := Marshal(packet)
+		if err != nil {
+			t.Fatalf("[% x] decoded as %+v, which can't be encoded: %v", frame, packet, err)
+		}
+		again, err := Unmarshal(out)
+		if err != nil {
+			t.Fatalf("[% x] encoded as [% x], which can't be decoded: %v", frame, out, err)
+		}
+		if !reflect.DeepEqual(again, packet) {
+			t.Fatalf("[% x] decoded as %+v, but as %+v after encoding", frame, packet, again)
+		}
+	})
+}
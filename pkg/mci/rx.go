@@ -0,0 +1,143 @@
+package mci
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Events with their own payload layout
+const (
+	EventStatusExt = 0x73
+	EventBasicMode = 0x80
+)
+
+const (
+	rxSize             = 10
+	extendedStatusSize = 10
+)
+
+/* RX payload:
+
+   0 = datapoint
+   1 = event
+   2 = data type
+   3 = info short, the status sent with status events
+   4-7 = value
+   8 = rssi
+   9 = battery state, bit 5 set if the message is cyclic */
+
+// RX is an event received from a datapoint
+type RX struct {
+	Datapoint byte
+	Event     byte
+	DataType  byte
+	InfoShort byte
+	Value     [4]byte
+	RSSI      byte
+	Battery   byte
+}
+
+func (RX) Type() PacketType { return PacketRX }
+
+// BatteryState returns the battery state, without the cyclic flag
+func (r RX) BatteryState() byte {
+	return r.Battery & 0x1f
+}
+
+// Cyclic returns true if the message was sent periodically, rather than
+// triggered by a change
+func (r RX) Cyclic() bool {
+	return r.Battery&0x20 != 0
+}
+
+func (r RX) marshal() []byte {
+	return []byte{r.Datapoint, r.Event, r.DataType, r.InfoShort,
+		r.Value[0], r.Value[1], r.Value[2], r.Value[3],
+		r.RSSI, r.Battery}
+}
+
+/* Extended status payload:
+
+   0 = datapoint
+   1 = event (0x73)
+   2 = data type, always serial number
+   3 = unused
+   4-7 = serial number (little endian)
+   8 = device type
+   9 = device subtype
+   10- = device specific status */
+
+// ExtendedStatus is a status message from a device, identified by its
+// serial number rather than datapoint
+type ExtendedStatus struct {
+	Datapoint  byte
+	DataType   byte
+	Reserved   byte
+	Serial     uint32
+	DeviceType byte
+	Subtype    byte
+	Data       []byte
+}
+
+func (ExtendedStatus) Type() PacketType { return PacketRX }
+
+func (e ExtendedStatus) marshal() []byte {
+	data := []byte{e.Datapoint, EventStatusExt, e.DataType, e.Reserved, 0, 0, 0, 0, e.DeviceType, e.Subtype}
+	binary.LittleEndian.PutUint32(data[4:8], e.Serial)
+	return append(data, e.Data...)
+}
+
+// BasicMode is received when a sensor is assigned to a datapoint in
+// learn mode
+type BasicMode struct {
+	Datapoint byte
+	Data      []byte
+}
+
+func (BasicMode) Type() PacketType { return PacketRX }
+
+func (b BasicMode) marshal() []byte {
+	return append([]byte{b.Datapoint, EventBasicMode}, b.Data...)
+}
+
+// UnmarshalRX decodes an RX payload, i.e. an RX frame without the packet
+// type, as found in RX frames and in the status list.
+func UnmarshalRX(data []byte) (Packet, error) {
+	if len(data) < 2 {
+		return nil, errors.Wrapf(ErrShortFrame, "RX is %d bytes", len(data))
+	}
+
+	switch data[1] {
+	case EventStatusExt:
+		if len(data) < extendedStatusSize {
+			return nil, errors.Wrapf(ErrShortFrame, "extended status is %d bytes", len(data))
+		}
+		return ExtendedStatus{
+			Datapoint:  data[0],
+			DataType:   data[2],
+			Reserved:   data[3],
+			Serial:     binary.LittleEndian.Uint32(data[4:8]),
+			DeviceType: data[8],
+			Subtype:    data[9],
+			Data:       data[10:],
+		}, nil
+
+	case EventBasicMode:
+		return BasicMode{Datapoint: data[0], Data: data[2:]}, nil
+
+	default:
+		if len(data) < rxSize {
+			return nil, errors.Wrapf(ErrShortFrame, "RX is %d bytes", len(data))
+		}
+		return RX{
+			Datapoint: data[0],
+			Event:     data[1],
+			DataType:  data[2],
+			InfoShort: data[3],
+			Value:     [4]byte{data[4], data[5], data[6], data[7]},
+			RSSI:      data[8],
+			Battery:   data[9],
+		}, nil
+	}
+}
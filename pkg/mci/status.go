@@ -0,0 +1,119 @@
+package mci
+
+// Status types
+const (
+	StatusConnex      = 0x02
+	StatusRS232Baud   = 0x03
+	StatusRS232Flow   = 0x05
+	StatusRS232CRC    = 0x06
+	StatusError       = 0x09
+	StatusTimeaccount = 0x0A
+	StatusCounterRX   = 0x0B
+	StatusCounterTX   = 0x0C
+	StatusSendOKMRF   = 0x0D
+	StatusSerial      = 0x0E
+	StatusLED         = 0x0F
+	StatusLEDDim      = 0x1A
+	StatusRelease     = 0x1B
+	StatusOK          = 0x1C
+	StatusSendClass   = 0x1D
+	StatusSendRFSeqNo = 0x1E
+)
+
+// Status codes, by status type
+const (
+	// StatusError
+	CodeGeneral      = 0x00
+	CodeUnknown      = 0x01
+	CodeDPOutOfRange = 0x02
+	CodeBusyMRF      = 0x03
+	CodeBusyMRFRX    = 0x04
+	CodeTXMsgLost    = 0x05
+	CodeNoAck        = 0x06
+
+	// StatusTimeaccount
+	CodeData   = 0x00
+	CodeIsZero = 0x01
+	CodeLess10 = 0x02
+	CodeMore15 = 0x03
+
+	// StatusRelease
+	CodeRevision = 0x10
+
+	// StatusOK
+	CodeOKMRF           = 0x04
+	CodeOKConfig        = 0x05
+	CodeOKBackToFactory = 0xCE
+)
+
+/* Status payload:
+
+   0 = status type
+   1 = status code, e.g. the error or the kind of OK
+   2- = status data
+
+   Responses to TX commands carry the sequence number of the TX in the
+   high nibble of the byte following the status code, or the byte after
+   that for general errors. */
+
+// Status is a response or notification from the CI
+type Status struct {
+	Status byte
+	Data   []byte
+}
+
+func (Status) Type() PacketType { return PacketStatus }
+
+// Code returns the status code, or false if there is none
+func (s Status) Code() (byte, bool) {
+	if len(s.Data) < 1 {
+		return 0, false
+	}
+	return s.Data[0], true
+}
+
+// Seq returns the sequence number of the TX command this status is a
+// response to, or false if it isn't a response to a TX command
+func (s Status) Seq() (byte, bool) {
+	pos, ok := s.seqPos()
+	if !ok {
+		return 0, false
+	}
+	return s.Data[pos] >> 4, true
+}
+
+// WithSeq returns a copy of the status with the sequence number replaced,
+// e.g. when passing on a response to a TX command that was renumbered.
+// Statuses without a sequence number are returned unchanged.
+func (s Status) WithSeq(seq byte) Status {
+	pos, ok := s.seqPos()
+	if !ok {
+		return s
+	}
+
+	data := append([]byte(nil), s.Data...)
+	data[pos] = data[pos]&0x0f | seq<<4
+	return Status{Status: s.Status, Data: data}
+}
+
+func (s Status) seqPos() (int, bool) {
+	code, ok := s.Code()
+	if !ok {
+		return 0, false
+	}
+
+	pos := 1
+	switch {
+	case s.Status == StatusError && code == CodeGeneral:
+		pos = 2
+	case s.Status == StatusError:
+	case s.Status == StatusOK && code == CodeOKMRF:
+	default:
+		return 0, false
+	}
+
+	if len(s.Data) <= pos {
+		return 0, false
+	}
+	return pos, true
+}
@@ -0,0 +1,62 @@
+package xc
+
+import (
+	"context"
+	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
+)
+
+/* Basic Mode lets the CI pair with actuators and sensors directly, without
+   the MRF software.  To assign an actuator, put the actuator in learn mode
+   and send an assignment for the datapoint that should control it.  To
+   assign a sensor, put the CI in learn mode and operate the sensor. */
+
+// LearnMode puts the CI in learn mode, or takes it out of learn mode
+func (i *Interface) LearnMode(ctx context.Context, on bool) error {
+	command := byte(MCI_TED_LEARNMODE_OFF)
+	if on {
+		command = MCI_TED_LEARNMODE_ON
+	}
+
+	_, err := i.sendTxCommand(ctx, mci.TX{Event: MCI_TE_BASICMODE, Data: []byte{command}})
+	return err
+}
+
+// AssignActuator assigns the datapoint to the actuator that is currently
+// in learn mode.  Returns ErrBasicModeNoTarget if no actuator is in learn
+// mode.
+func (i *Interface) AssignActuator(ctx context.Context, number int) error {
+	return i.sendBasicMode(ctx, number, MCI_TED_ASSIGN_ACTUATOR)
+}
+
+// RemoveActuator removes the assignment between the datapoint and the
+// actuator that is currently in learn mode.
+func (i *Interface) RemoveActuator(ctx context.Context, number int) error {
+	return i.sendBasicMode(ctx, number, MCI_TED_REMOVE_ACTUATOR)
+}
+
+// RemoveSensor removes the sensor assigned to the datapoint from the CI.
+func (i *Interface) RemoveSensor(ctx context.Context, number int) error {
+	return i.sendBasicMode(ctx, number, MCI_TED_REMOVE_SENSOR)
+}
+
+// sendBasicMode sends a basic mode command for the datapoint, which must be
+// in range, since the CI would otherwise act on another datapoint
+func (i *Interface) sendBasicMode(ctx context.Context, number int, command byte) error {
+	if number < 0 || number > 255 {
+		return errors.Wrapf(ErrDpOutOfRange, "datapoint %d", number)
+	}
+
+	_, err := i.sendTxCommand(ctx, mci.TX{Datapoint: byte(number), Event: MCI_TE_BASICMODE, Data: []byte{command}})
+	return err
+}
+
+func (i *Interface) basicMode(event mci.BasicMode) error {
+	log.Printf("Sensor assigned to datapoint %d in basic mode", event.Datapoint)
+	i.handler.SensorAssigned(int(event.Datapoint))
+
+	return nil
+}
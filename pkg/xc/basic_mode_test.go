@@ -0,0 +1,40 @@
+package xc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestBasicModeOutOfRange(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	commands := map[string]func(context.Context, int) error{
+		"assign":          i.AssignActuator,
+		"remove actuator": i.RemoveActuator,
+		"remove sensor":   i.RemoveSensor,
+	}
+	for name, fn := range commands {
+		for _, number := range []int{-1, 256, 300} {
+			if err := fn(ctx, number); !errors.Is(err, ErrDpOutOfRange) {
+				t.Errorf("%s %d: got %v, expected ErrDpOutOfRange", name, number, err)
+			}
+		}
+	}
+
+	select {
+	case frame := <-ci.written:
+		t.Fatalf("sent [% x]", frame)
+	default:
+	}
+}
@@ -0,0 +1,190 @@
+package xc
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CaptureIn  = "in"
+	CaptureOut = "out"
+
+	// Longest time Replay waits for the commands preceding a frame
+	replayWriteTimeout = time.Second
+)
+
+// CaptureRecord is a frame read from or written to the stick, as written
+// by Capture, one JSON object per line
+type CaptureRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Frame     string    `json:"frame"`
+}
+
+type captureConn struct {
+	conn io.ReadWriteCloser
+
+	m   sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// Capture returns a connection that writes every frame read from or
+// written to conn to w, with timestamps.  Closing it closes both.
+func Capture(conn io.ReadWriteCloser, w io.WriteCloser) io.ReadWriteCloser {
+	return &captureConn{conn: conn, w: w, enc: json.NewEncoder(w)}
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	if n > 0 {
+		c.record(CaptureIn, p[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	c.record(CaptureOut, p)
+	return c.conn.Write(p)
+}
+
+func (c *captureConn) Close() error {
+	err := c.conn.Close()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if cerr := c.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *captureConn) record(direction string, frame []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// Capturing is best effort, and mustn't disturb the connection
+	_ = c.enc.Encode(CaptureRecord{time.Now(), direction, hex.EncodeToString(frame)})
+}
+
+type replayFrame struct {
+	frame []byte
+	// number of frames written before this one in the capture
+	writesBefore int
+}
+
+// Replay is a connection that plays back a capture made with Capture.
+// The frames read from the stick are returned by Read in order, each once
+// the frames written before it in the capture have been written, or after
+// at most a second, so that responses line up with their commands.
+// Written frames are otherwise discarded.  Read returns io.EOF at the end
+// of the capture.
+type Replay struct {
+	frames []replayFrame
+
+	m       sync.Mutex
+	cond    *sync.Cond
+	written int
+	closed  bool
+}
+
+// NewReplay reads a capture made with Capture
+func NewReplay(r io.Reader) (*Replay, error) {
+	replay := &Replay{}
+	replay.cond = sync.NewCond(&replay.m)
+
+	scanner := bufio.NewScanner(r)
+	writes := 0
+	for line := 1; scanner.Scan(); line++ {
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+
+		switch record.Direction {
+		case CaptureIn:
+			frame, err := hex.DecodeString(record.Frame)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", line)
+			}
+			replay.frames = append(replay.frames, replayFrame{frame, writes})
+		case CaptureOut:
+			writes++
+		default:
+			return nil, errors.Errorf("line %d: unknown direction '%s'", line, record.Direction)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return replay, nil
+}
+
+func (r *Replay) Read(p []byte) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.frames) == 0 || r.closed {
+		return 0, io.EOF
+	}
+
+	next := r.frames[0]
+	if len(p) < len(next.frame) {
+		// Left for a read with a larger buffer
+		return 0, io.ErrShortBuffer
+	}
+
+	if r.written < next.writesBefore {
+		timedOut := false
+		timer := time.AfterFunc(replayWriteTimeout, func() {
+			r.m.Lock()
+			defer r.m.Unlock()
+
+			timedOut = true
+			r.cond.Broadcast()
+		})
+		for r.written < next.writesBefore && !timedOut && !r.closed {
+			r.cond.Wait()
+		}
+		timer.Stop()
+
+		if r.closed {
+			return 0, io.EOF
+		}
+	}
+
+	r.frames = r.frames[1:]
+	return copy(p, next.frame), nil
+}
+
+func (r *Replay) Write(p []byte) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	r.written++
+	r.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (r *Replay) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.closed = true
+	r.cond.Broadcast()
+
+	return nil
+}
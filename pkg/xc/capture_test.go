@@ -0,0 +1,108 @@
+package xc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHandler records the callbacks from the interface
+type recordingHandler struct {
+	nopHandler
+
+	m     sync.Mutex
+	calls []string
+}
+
+func (h *recordingHandler) record(format string, args ...interface{}) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.calls = append(h.calls, fmt.Sprintf(format, args...))
+}
+
+func (h *recordingHandler) StatusValue(dp *Datapoint, value int) {
+	h.record("%d value %d", dp.Number(), value)
+}
+
+func (h *recordingHandler) StatusBool(dp *Datapoint, on bool) {
+	h.record("%d on %v", dp.Number(), on)
+}
+
+func (h *recordingHandler) Event(dp *Datapoint, event Event) {
+	h.record("%d event %s", dp.Number(), event)
+}
+
+func (h *recordingHandler) ValueEvent(dp *Datapoint, event Event, value interface{}) {
+	h.record("%d event %s value %v", dp.Number(), event, value)
+}
+
+func (h *recordingHandler) Valve(dp *Datapoint, position int) {
+	h.record("%d valve %d", dp.Number(), position)
+}
+
+func TestReplay(t *testing.T) {
+	f, err := os.Open("testdata/session.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	replay, err := NewReplay(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &recordingHandler{}
+	i := &Interface{}
+	i.Init(h, false)
+	if err := i.ReadFile("testdata/sample.dpl"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- i.Run(ctx, replay)
+	}()
+
+	res, err := i.Datapoint(1).Switch(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Ack != AckDirect {
+		t.Errorf("got ack %s, expected %s", res.Ack, AckDirect)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"1 on true",
+		"2 value 50",
+		"3 event switchOn",
+		"4 event value value 23",
+	}
+	if !reflect.DeepEqual(h.calls, expected) {
+		t.Errorf("got %q, expected %q", h.calls, expected)
+	}
+}
+
+func TestReplayShortBuffer(t *testing.T) {
+	replay := &Replay{frames: []replayFrame{{frame: []byte{3, 0xD1, 0x22}}}}
+
+	if _, err := replay.Read(make([]byte, 2)); err != io.ErrShortBuffer {
+		t.Fatalf("got %v, expected io.ErrShortBuffer", err)
+	}
+	if n, err := replay.Read(make([]byte, 3)); n != 3 || err != nil {
+		t.Fatalf("got %d, %v, expected the frame on the next read", n, err)
+	}
+}
@@ -1,51 +1,68 @@
 package xc
 
 import (
+	"context"
 	"encoding/binary"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
 )
 
-func (i *Interface) Serial() (uint32, error) {
-	data, err := i.sendConfigCommand([]byte{CONF_SERIAL, CF_DATA_GET})
+func (i *Interface) Serial(ctx context.Context) (uint32, error) {
+	data, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_SERIAL, Data: []byte{CF_DATA_GET}})
 	if err != nil {
 		return 0, err
 	}
+	if err := checkLength(data, 5); err != nil {
+		return 0, err
+	}
 
 	return binary.BigEndian.Uint32(data[1:]), nil
 }
 
-func (i *Interface) SetOKMRF() error {
-	_, err := i.sendConfigCommand([]byte{CONF_SEND_OK_MRF, CF_DATA_SET})
+func (i *Interface) SetOKMRF(ctx context.Context) error {
+	_, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_SEND_OK_MRF, Data: []byte{CF_DATA_SET}})
 	return err
 }
 
-func (i *Interface) SetRfSeqNo() error {
-	_, err := i.sendConfigCommand([]byte{CONF_SEND_RFSEQNO, CF_DATA_SET})
+func (i *Interface) SetRfSeqNo(ctx context.Context) error {
+	_, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_SEND_RFSEQNO, Data: []byte{CF_DATA_SET}})
 	return err
 }
 
-func (i *Interface) GetCounterRx() (uint32, error) {
-	data, err := i.sendConfigCommand([]byte{CONF_COUNTER_RX, CF_DATA_GET})
+func (i *Interface) GetCounterRx(ctx context.Context) (uint32, error) {
+	data, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_COUNTER_RX, Data: []byte{CF_DATA_GET}})
 	if err != nil {
 		return 0, err
 	}
+	if err := checkLength(data, 5); err != nil {
+		return 0, err
+	}
 
 	return binary.BigEndian.Uint32(data[1:]), nil
 }
 
-func (i *Interface) GetCounterTx() (uint32, error) {
-	data, err := i.sendConfigCommand([]byte{CONF_COUNTER_TX, CF_DATA_GET})
+func (i *Interface) GetCounterTx(ctx context.Context) (uint32, error) {
+	data, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_COUNTER_TX, Data: []byte{CF_DATA_GET}})
 	if err != nil {
 		return 0, err
 	}
+	if err := checkLength(data, 5); err != nil {
+		return 0, err
+	}
 
 	return binary.BigEndian.Uint32(data[1:]), nil
 }
 
-func (i *Interface) Release() (rf, fw float32, err error) {
-	data, err := i.sendConfigCommand([]byte{CONF_RELEASE, CF_DATA_GET})
+func (i *Interface) Release(ctx context.Context) (rf, fw float32, err error) {
+	data, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_RELEASE, Data: []byte{CF_DATA_GET}})
 	if err != nil {
 		return 0, 0, err
 	}
+	if err := checkLength(data, 5); err != nil {
+		return 0, 0, err
+	}
 
 	rf = float32(data[1]) + float32(data[2])/100.0
 	fw = float32(data[3]) + float32(data[4])/100.0
@@ -53,11 +70,14 @@ func (i *Interface) Release() (rf, fw float32, err error) {
 	return
 }
 
-func (i *Interface) Revision() (hw, rf, fw int, err error) {
-	data, err := i.sendConfigCommand([]byte{CONF_RELEASE, CF_DATA_GET_REVISION})
+func (i *Interface) Revision(ctx context.Context) (hw, rf, fw int, err error) {
+	data, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_RELEASE, Data: []byte{CF_DATA_GET_REVISION}})
 	if err != nil {
 		return 0, 0, 0, err
 	}
+	if err := checkLength(data, 5); err != nil {
+		return 0, 0, 0, err
+	}
 
 	hw = int(data[1])
 	rf = int(data[2])
@@ -65,3 +85,25 @@ func (i *Interface) Revision() (hw, rf, fw int, err error) {
 
 	return
 }
+
+// RequestTimeaccount asks the stick for its remaining transmission budget,
+// in percent; see also Timeaccount
+func (i *Interface) RequestTimeaccount(ctx context.Context) (int, error) {
+	data, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_TIMEACCOUNT, Data: []byte{CF_DATA_GET}})
+	if err != nil {
+		return 0, err
+	}
+	if err := checkLength(data, 2); err != nil {
+		return 0, err
+	}
+
+	return int(data[1]), nil
+}
+
+// checkLength fails if a response is shorter than expected
+func checkLength(data []byte, size int) error {
+	if len(data) < size {
+		return errors.Wrapf(ErrMalformedMessage, "response is %d bytes, expected %d", len(data), size)
+	}
+	return nil
+}
@@ -1,11 +1,13 @@
 package xc
 
+import "github.com/karloygard/xcomfortd-go/pkg/mci"
+
 const (
-	MCI_PT_TX       = 0xB1
-	MCI_PT_CONFIG   = 0xB2
-	MCI_PT_RX       = 0xC1
-	MCI_PT_STATUS   = 0xC3
-	MCI_PT_EXTENDED = 0xD1
+	MCI_PT_TX       = byte(mci.PacketTX)
+	MCI_PT_CONFIG   = byte(mci.PacketConfig)
+	MCI_PT_RX       = byte(mci.PacketRX)
+	MCI_PT_STATUS   = byte(mci.PacketStatus)
+	MCI_PT_EXTENDED = byte(mci.PacketExtended)
 )
 
 /* Events that can be sent to datapoints with MGW_PT_TX.  Not all events
@@ -100,8 +102,8 @@ const (
 	RX_EVENT_TOO_COLD      = 0x63
 	RX_EVENT_TOO_WARM      = 0x64
 	RX_EVENT_STATUS        = 0x70
-	RX_EVENT_STATUS_EXT    = 0x73
-	RX_EVENT_BASIC_MODE    = 0x80
+	RX_EVENT_STATUS_EXT    = mci.EventStatusExt
+	RX_EVENT_BASIC_MODE    = mci.EventBasicMode
 )
 
 var rxEventMap = map[byte]Event{
@@ -224,22 +226,22 @@ const (
    the MGW_PT_STATUS message. */
 
 const (
-	MGW_STT_CONNEX       = 0x02
-	MGW_STT_RS232_BAUD   = 0x03
-	MGW_STT_RS232_FLOW   = 0x05
-	MGW_STT_RS232_CRC    = 0x06
-	MCI_STT_ERROR        = 0x09
-	MCI_STT_TIMEACCOUNT  = 0x0A
-	MCI_STT_COUNTER_RX   = 0x0B
-	MCI_STT_COUNTER_TX   = 0x0C
-	MGW_STT_SEND_OK_MRF  = 0x0D
-	MGW_STT_SERIAL       = 0x0E
-	MGW_STT_LED          = 0x0F
-	MGW_STT_LED_DIM      = 0x1A
-	MGW_STT_RELEASE      = 0x1B
-	MGW_STT_OK           = 0x1C
-	MGW_STT_SEND_CLASS   = 0x1D
-	MGW_STT_SEND_RFSEQNO = 0x1E
+	MGW_STT_CONNEX       = mci.StatusConnex
+	MGW_STT_RS232_BAUD   = mci.StatusRS232Baud
+	MGW_STT_RS232_FLOW   = mci.StatusRS232Flow
+	MGW_STT_RS232_CRC    = mci.StatusRS232CRC
+	MCI_STT_ERROR        = mci.StatusError
+	MCI_STT_TIMEACCOUNT  = mci.StatusTimeaccount
+	MCI_STT_COUNTER_RX   = mci.StatusCounterRX
+	MCI_STT_COUNTER_TX   = mci.StatusCounterTX
+	MGW_STT_SEND_OK_MRF  = mci.StatusSendOKMRF
+	MGW_STT_SERIAL       = mci.StatusSerial
+	MGW_STT_LED          = mci.StatusLED
+	MGW_STT_LED_DIM      = mci.StatusLEDDim
+	MGW_STT_RELEASE      = mci.StatusRelease
+	MGW_STT_OK           = mci.StatusOK
+	MGW_STT_SEND_CLASS   = mci.StatusSendClass
+	MGW_STT_SEND_RFSEQNO = mci.StatusSendRFSeqNo
 )
 
 const (
@@ -260,27 +262,27 @@ const (
 
 const (
 	// MCI_STT_ERROR
-	MCI_STS_GENERAL     = 0x00
-	MCI_STS_UNKNOWN     = 0x01
-	MCI_STS_DP_OOR      = 0x02
-	MCI_STS_BUSY_MRF    = 0x03
-	MCI_STS_BUSY_MRF_RX = 0x04
-	MCI_STS_TX_MSG_LOST = 0x05
-	MCI_STS_NO_ACK      = 0x06
+	MCI_STS_GENERAL     = mci.CodeGeneral
+	MCI_STS_UNKNOWN     = mci.CodeUnknown
+	MCI_STS_DP_OOR      = mci.CodeDPOutOfRange
+	MCI_STS_BUSY_MRF    = mci.CodeBusyMRF
+	MCI_STS_BUSY_MRF_RX = mci.CodeBusyMRFRX
+	MCI_STS_TX_MSG_LOST = mci.CodeTXMsgLost
+	MCI_STS_NO_ACK      = mci.CodeNoAck
 
 	// MCI_STT_TIMEACCOUNT
-	STATUS_DATA    = 0x00
-	STATUS_IS_0    = 0x01
-	STATUS_LESS_10 = 0x02
-	STATUS_MORE_15 = 0x03
+	STATUS_DATA    = mci.CodeData
+	STATUS_IS_0    = mci.CodeIsZero
+	STATUS_LESS_10 = mci.CodeLess10
+	STATUS_MORE_15 = mci.CodeMore15
 
 	// MGW_STT_RELEASE
-	STATUS_REVISION = 0x10
+	STATUS_REVISION = mci.CodeRevision
 
 	// MGW_STT_OK
-	STATUS_OK_MRF    = 0x04
-	STATUS_OK_CONFIG = 0x05
-	STATUS_OK_BTFACT = 0xCE
+	STATUS_OK_MRF    = mci.CodeOKMRF
+	STATUS_OK_CONFIG = mci.CodeOKConfig
+	STATUS_OK_BTFACT = mci.CodeOKBackToFactory
 )
 
 const (
@@ -349,4 +351,5 @@ const (
 	MCI_SER_STOP  = 0xA5
 )
 
+// The only DPL type seen in files exported by the MRF software
 const DPL_TYPE_EXT2 = 2
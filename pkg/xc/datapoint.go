@@ -6,16 +6,19 @@ import (
 	"fmt"
 	"log"
 	"math"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
 type Datapoint struct {
-	device  *Device
-	name    string
-	number  byte
-	channel int
-	mode    int
-	sensor  bool
-	queue   Queue
+	device   *Device
+	name     string
+	number   byte
+	channel  int
+	mode     int
+	sensor   bool
+	location Location
+	queue    Queue
 
 	// Used only by HRV
 	asyncDesiredTemperature float32
@@ -46,6 +49,10 @@ func (dp *Datapoint) fullname() string {
 	return fmt.Sprintf("%s (%s)", dp.device.Name(), dp.name)
 }
 
+func (dp *Datapoint) Location() Location {
+	return dp.location
+}
+
 func (dp *Datapoint) Channel() int {
 	return dp.channel
 }
@@ -67,23 +74,23 @@ func (dp *Datapoint) Type() channelType {
 	return info.channels[dp.channel]
 }
 
-func (dp *Datapoint) rx(ctx context.Context, h Handler, data []byte) (err error) {
+func (dp *Datapoint) rx(ctx context.Context, h Handler, rx mci.RX) (err error) {
 	description := "unknown"
 
-	dp.device.setRssi(h, SignalStrength(data[7]))
-	dp.device.setBattery(h, BatteryState(data[8]&0x1f))
+	dp.device.setRssi(h, SignalStrength(rx.RSSI))
+	dp.device.setBattery(h, BatteryState(rx.BatteryState()))
 
-	cyclic := (data[8] & 0x20) == 0x20
+	cyclic := rx.Cyclic()
 
-	if data[0] == RX_EVENT_STATUS {
-		description, err = dp.status(h, data[2])
+	if rx.Event == RX_EVENT_STATUS {
+		description, err = dp.status(h, rx.InfoShort)
 	} else {
-		event, exists := rxEventMap[data[0]]
+		event, exists := rxEventMap[rx.Event]
 		if !exists {
-			log.Printf("unexpected event %d; ignoring", data[0])
-			err = errMsgNotHandled
+			log.Printf("unexpected event %d; ignoring", rx.Event)
+			err = notHandled("unknown event")
 		} else {
-			description, err = dp.event(ctx, h, event, data[1:])
+			description, err = dp.event(ctx, h, event, rx.DataType, rx.Value)
 		}
 	}
 	log.Printf("Device %d (channel %d-'%s') sent message (battery %s, signal %s, cyclic %v) %s",
@@ -105,6 +112,7 @@ func (dp *Datapoint) status(h Handler, status byte) (string, error) {
 			return "status switched on", nil
 		default:
 			log.Printf("unknown switching actuator status %d\n", status)
+			return "unknown", notHandled("unknown status")
 		}
 
 	case dp.device.IsDimmingActuator():
@@ -118,52 +126,52 @@ func (dp *Datapoint) status(h Handler, status byte) (string, error) {
 		log.Printf("unknown status %d for unsupported device %d\n", status, dp.device.deviceType)
 	}
 
-	return "unknown", errMsgNotHandled
+	return "unknown", notHandled("status from unsupported device")
 }
 
 func (dp *Datapoint) event(ctx context.Context,
-	h Handler, event Event, data []byte) (string, error) {
+	h Handler, event Event, dataType byte, data [4]byte) (string, error) {
 
 	var value any
 
-	switch data[0] {
+	switch dataType {
 	case RX_DATA_TYPE_RC_DATA:
-		value = float32(int16(binary.BigEndian.Uint16(data[2:4]))) / 10
-		wheel := float32(int16(binary.BigEndian.Uint16(data[4:6]))) / 10
+		value = float32(int16(binary.BigEndian.Uint16(data[:2]))) / 10
+		wheel := float32(int16(binary.BigEndian.Uint16(data[2:4]))) / 10
 		h.Wheel(dp, wheel)
 		log.Printf("wheel position: %.1f", wheel)
 	case RX_DATA_TYPE_UINT16_1POINT:
-		value = float32(binary.BigEndian.Uint16(data[2:4])) / 10
+		value = float32(binary.BigEndian.Uint16(data[:2])) / 10
 	case RX_DATA_TYPE_INT16_1POINT:
-		value = float32(int16(binary.BigEndian.Uint16(data[2:4]))) / 10
+		value = float32(int16(binary.BigEndian.Uint16(data[:2]))) / 10
 	case RX_DATA_TYPE_UINT16_2POINT:
-		value = float32(binary.BigEndian.Uint16(data[2:4])) / 100
+		value = float32(binary.BigEndian.Uint16(data[:2])) / 100
 	case RX_DATA_TYPE_UINT16_3POINT:
-		value = float32(binary.BigEndian.Uint16(data[2:4])) / 1000
+		value = float32(binary.BigEndian.Uint16(data[:2])) / 1000
 	case RX_DATA_TYPE_UINT32_3POINT:
-		value = float32(binary.BigEndian.Uint32(data[2:6])) / 1000
+		value = float32(binary.BigEndian.Uint32(data[:])) / 1000
 	case RX_DATA_TYPE_UINT32:
-		value = binary.BigEndian.Uint32(data[2:6])
+		value = binary.BigEndian.Uint32(data[:])
 	case RX_DATA_TYPE_UINT16:
-		value = binary.BigEndian.Uint16(data[2:4])
+		value = binary.BigEndian.Uint16(data[:2])
 	case RX_DATA_TYPE_UINT8:
-		value = data[2]
+		value = data[0]
 	case RX_DATA_TYPE_FLOAT:
-		value = math.Float32frombits(binary.BigEndian.Uint32(data[2:6]))
+		value = math.Float32frombits(binary.BigEndian.Uint32(data[:]))
 	case RX_DATA_TYPE_PERCENT:
-		value = float32(data[2]) * 100 / 255
+		value = float32(data[0]) * 100 / 255
 	case RX_DATA_TYPE_RCT_OUT:
-		moisture := float32(binary.LittleEndian.Uint16(data[2:4])) / 10
-		temperature := float32(binary.LittleEndian.Uint16(data[4:6])) / 10
+		moisture := float32(binary.LittleEndian.Uint16(data[:2])) / 10
+		temperature := float32(binary.LittleEndian.Uint16(data[2:4])) / 10
 		log.Printf("(partially decoded) temp %.1fC moisture %.1f%%", temperature, moisture)
-		return "RCT OUT", errMsgNotHandled
+		return "RCT OUT", notHandled("partially decoded data type")
 	case RX_DATA_TYPE_RCT_REQ:
-		return "RCT REQ", errMsgNotHandled
+		return "RCT REQ", notHandled("unhandled data type")
 	case RX_DATA_TYPE_NO_DATA:
 		h.Event(dp, event)
 		return fmt.Sprintf("event '%s'\n", event), nil
 	case RX_DATA_TYPE_HRV_OUT:
-		status := data[2]
+		status := data[0]
 		if (status & MGW_HRV_ERROR_CONNECTION_LOST) != 0 {
 			log.Printf("Connection lost")
 		}
@@ -183,10 +191,10 @@ func (dp *Datapoint) event(ctx context.Context,
 			log.Printf("Device in deep sleep")
 		}
 
-		h.Valve(dp, int(data[3]))
-		currentTemperature := (float32(data[4]&0xf)*256 + float32(data[5])) / 10.0
+		h.Valve(dp, int(data[1]))
+		currentTemperature := (float32(data[2]&0xf)*256 + float32(data[3])) / 10.0
 
-		switch data[4] >> 4 {
+		switch data[2] >> 4 {
 		case MGW_HRV_REQ_NOTHING:
 		case MGW_HRV_REQ_TSETPOINT:
 			if dp.device.iface.verbose {
@@ -202,8 +210,8 @@ func (dp *Datapoint) event(ctx context.Context,
 		value = currentTemperature
 
 	default:
-		log.Printf("unhandled data type %d for event '%s'", data[0], event)
-		return "unknown", errMsgNotHandled
+		log.Printf("unhandled data type %d for event '%s'", dataType, event)
+		return "unknown", notHandled("unhandled data type")
 	}
 
 	h.ValueEvent(dp, event, value)
@@ -1,8 +1,13 @@
 package xc
 
 import (
+	"fmt"
 	"log"
 	"strconv"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
 )
 
 // Device represents an xComfort device
@@ -11,6 +16,8 @@ type Device struct {
 	subtype      byte
 	serialNumber int
 	name         string
+	location     Location
+	swVersion    string
 	rssi         SignalStrength
 	battery      BatteryState
 	iface        *Interface
@@ -79,6 +86,20 @@ func (d Device) SerialNumber() int {
 	return d.serialNumber
 }
 
+// Datapoints returns the datapoints belonging to the device
+func (d Device) Datapoints() []*Datapoint {
+	return d.datapoints
+}
+
+func (d *Device) removeDatapoint(dp *Datapoint) {
+	for i := range d.datapoints {
+		if d.datapoints[i] == dp {
+			d.datapoints = append(d.datapoints[:i], d.datapoints[i+1:]...)
+			return
+		}
+	}
+}
+
 func (d Device) Name() string {
 	if d.name == "" {
 		return strconv.Itoa(d.SerialNumber())
@@ -108,6 +129,30 @@ func (d *Device) setName(name string) {
 	}
 }
 
+// Location returns the location of the device, taken from the first of its
+// datapoints that has a location.
+func (d Device) Location() Location {
+	return d.location
+}
+
+func (d *Device) setLocation(location Location) {
+	if d.location.IsZero() {
+		d.location = location
+	}
+}
+
+// SoftwareVersion returns the firmware version of the device, as recorded
+// in the datapoint list, or an empty string if unknown.
+func (d Device) SoftwareVersion() string {
+	return d.swVersion
+}
+
+func (d *Device) setSoftwareVersion(major, minor byte) {
+	if d.swVersion == "" && (major != 0 || minor != 0) {
+		d.swVersion = fmt.Sprintf("%d.%02d", major, minor)
+	}
+}
+
 func (d *Device) setRssi(h Handler, rssi SignalStrength) {
 	d.rssi = rssi
 	h.Rssi(d, int(rssi))
@@ -118,27 +163,45 @@ func (d *Device) setBattery(h Handler, battery BatteryState) {
 	h.Battery(d, battery.percentage())
 }
 
-func (d *Device) extendedStatus(h Handler, data []byte) error {
-	if d.deviceType != DeviceType(data[0]) {
-		log.Printf("received non matching device type in extended status message %d, expected %d\n", data[0], d.deviceType)
-		return errMsgNotHandled
+// Size of the device specific data in extended status messages
+const (
+	extendedStatusDimmerSize  = 9
+	extendedStatusSwitchSize  = 7
+	extendedStatusHeatingSize = 7
+	extendedStatusShutterSize = 2
+)
+
+func (d *Device) extendedStatus(h Handler, status mci.ExtendedStatus) error {
+	if d.deviceType != DeviceType(status.DeviceType) {
+		log.Printf("received non matching device type in extended status message %d, expected %d\n", status.DeviceType, d.deviceType)
+		return notHandled("device type mismatch")
 	}
 
-	d.subtype = data[1]
+	var handler func(Handler, []byte)
+	var size int
+
 	switch {
 	case d.IsDimmingActuator():
-		d.extendedStatusDimmer(h, data[2:])
+		handler, size = d.extendedStatusDimmer, extendedStatusDimmerSize
 	case d.IsSwitchingActuator():
-		d.extendedStatusSwitch(h, data[2:])
+		handler, size = d.extendedStatusSwitch, extendedStatusSwitchSize
 	case d.IsHeatingActuator():
-		d.extendedStatusHeatingActuator(h, data[2:])
+		handler, size = d.extendedStatusHeatingActuator, extendedStatusHeatingSize
 	case d.IsShutter():
-		d.extendedStatusShutter(h, data[2:])
+		handler, size = d.extendedStatusShutter, extendedStatusShutterSize
 	default:
 		log.Printf("Device type: %s", d.deviceType)
-		log.Printf("extended status message from unhandled device %d", data[0])
-		return errMsgNotHandled
+		log.Printf("extended status message from unhandled device %d", status.DeviceType)
+		return notHandled("unhandled device type")
 	}
 
+	if len(status.Data) < size {
+		return errors.Wrapf(ErrMalformedMessage, "extended status from device %d is %d bytes, expected %d",
+			d.serialNumber, len(status.Data), size)
+	}
+
+	d.subtype = status.Subtype
+	handler(h, status.Data)
+
 	return nil
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/binary"
 	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
 /* New dimming actuator output channels:
@@ -48,28 +50,28 @@ func dimmerName(subtype byte) string {
 	return "unknown"
 }
 
-func (d *Datapoint) Dim(ctx context.Context, value int) ([]byte, error) {
+func (d *Datapoint) Dim(ctx context.Context, value int) (TxResult, error) {
 	last := d.queue.Lock()
 	defer d.queue.Unlock()
 
 	if !last {
 		// There are newer commands, discard
-		return nil, nil
+		return TxResult{Discarded: true}, nil
 	}
 
-	return d.device.iface.sendTxCommand(ctx, []byte{d.number, MCI_TE_DIM, MCI_TED_PERCENT, byte(value)})
+	return d.device.iface.sendTxCommand(ctx, mci.TX{Datapoint: d.number, Event: MCI_TE_DIM, Data: []byte{MCI_TED_PERCENT, byte(value)}})
 }
 
-func (d *Datapoint) DimWithSpeed(ctx context.Context, value, speed int) ([]byte, error) {
+func (d *Datapoint) DimWithSpeed(ctx context.Context, value, speed int) (TxResult, error) {
 	last := d.queue.Lock()
 	defer d.queue.Unlock()
 
 	if !last {
 		// There are newer commands, discard
-		return nil, nil
+		return TxResult{Discarded: true}, nil
 	}
 
-	return d.device.iface.sendTxCommand(ctx, []byte{d.number, MCI_TE_DIRECT, MCI_TED_DIRECT_DIM, byte(value), byte(speed)})
+	return d.device.iface.sendTxCommand(ctx, mci.TX{Datapoint: d.number, Event: MCI_TE_DIRECT, Data: []byte{MCI_TED_DIRECT_DIM, byte(value), byte(speed)}})
 }
 
 func (d *Device) extendedStatusDimmer(h Handler, data []byte) {
@@ -0,0 +1,64 @@
+package xc
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DPLDiff lists the datapoints that were added, removed or changed when the
+// datapoint list was replaced.  Removed holds the datapoints from the old
+// list, the others hold datapoints from the new list.
+type DPLDiff struct {
+	Added   []*Datapoint
+	Removed []*Datapoint
+	Changed []*Datapoint
+}
+
+func (d DPLDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d DPLDiff) String() string {
+	return fmt.Sprintf("added %v, removed %v, changed %v",
+		DatapointNumbers(d.Added), DatapointNumbers(d.Removed), DatapointNumbers(d.Changed))
+}
+
+// DatapointNumbers returns the sorted numbers of dps
+func DatapointNumbers(dps []*Datapoint) []int {
+	n := make([]int, 0, len(dps))
+	for _, dp := range dps {
+		n = append(n, dp.Number())
+	}
+	sort.Ints(n)
+	return n
+}
+
+func diffDatapoints(old, new map[byte]*Datapoint) (diff DPLDiff) {
+	for number, dp := range new {
+		if o, exists := old[number]; !exists {
+			diff.Added = append(diff.Added, dp)
+		} else if !o.equal(dp) {
+			diff.Changed = append(diff.Changed, dp)
+		}
+	}
+
+	for number, dp := range old {
+		if _, exists := new[number]; !exists {
+			diff.Removed = append(diff.Removed, dp)
+		}
+	}
+
+	return
+}
+
+// equal returns true if the datapoints have the same configuration
+func (dp *Datapoint) equal(o *Datapoint) bool {
+	return dp.device.serialNumber == o.device.serialNumber &&
+		dp.device.deviceType == o.device.deviceType &&
+		dp.device.Name() == o.device.Name() &&
+		dp.name == o.name &&
+		dp.channel == o.channel &&
+		dp.mode == o.mode &&
+		dp.sensor == o.sensor &&
+		dp.location == o.location
+}
@@ -7,21 +7,50 @@ import (
 
 var (
 	ErrTerminal          = errors.New("terminal error")
+	ErrShuttingDown      = errors.New("shutting down")
 	ErrUnknown           = errors.New("message unknown")
 	ErrDpOutOfRange      = errors.New("datapoint out of range")
 	ErrBusyMRF           = errors.New("RF busy, TX msg lost")
 	ErrBusyMRFRX         = errors.New("RF busy, RX in progress")
 	ErrTxMsgLost         = errors.New("TX lost, repeat it, buffer full")
 	ErrNoAck             = errors.New("timeout, no ACK received")
+	ErrNoResponse        = errors.New("stick didn't respond")
+	ErrDatapointRemoved  = errors.New("datapoint has been removed")
+	ErrMalformedMessage  = errors.New("malformed message")
 	ErrUnrecognisedError = errors.New("unknown error")
+	ErrBasicModeNoTarget = errors.New("basic mode: no target available, is the actuator in learn mode?")
+	ErrTimeaccountZero   = errors.New("timeaccount zero, no more transmission possible")
 
 	ErrUnknownDPLFormat = errors.New("unsupported DPL format, broken file or you didn't upload the DPL to the stick?")
+	ErrCorruptDPL       = errors.New("corrupt DPL")
+	ErrUnknownSTLFormat = errors.New("unsupported status list format")
+
+	// Returned when reading from a stream with start/stop bytes that has
+	// lost framing; reading again resyncs on the next start byte
+	ErrStartStopByte = errors.New("packet missing start/stop byte")
 
 	errUnexpectedReponse = errors.New("unexpected response")
-	errStartStopByte     = errors.New("packet missing start/stop byte")
 	errMsgNotHandled     = errors.New("unhandled message")
 )
 
+// notHandledError is returned for messages that can't be decoded, with
+// the reason, and matches errMsgNotHandled
+type notHandledError struct {
+	reason string
+}
+
+func notHandled(reason string) error {
+	return notHandledError{reason}
+}
+
+func (e notHandledError) Error() string {
+	return fmt.Sprintf("%s: %s", errMsgNotHandled, e.reason)
+}
+
+func (e notHandledError) Is(target error) bool {
+	return target == errMsgNotHandled
+}
+
 var generalErrorString = map[byte]string{
 	ERR_T_SWITCH:          "Invalid SWITCH data",
 	ERR_T_PERCENT:         "Invalid PERCENT value",
@@ -67,8 +96,18 @@ func (e ErrGeneral) Error() string {
 }
 
 func errorMessage(data []byte) error {
+	if len(data) == 0 {
+		return ErrUnrecognisedError
+	}
+
 	switch data[0] {
 	case MCI_STS_GENERAL:
+		if len(data) < 3 {
+			return ErrUnrecognisedError
+		}
+		if data[2] == ERR_T_BM_NO_TARGET {
+			return ErrBasicModeNoTarget
+		}
 		return ErrGeneral{data[2]}
 	case MCI_STS_UNKNOWN:
 		return ErrUnknown
@@ -87,10 +126,27 @@ func errorMessage(data []byte) error {
 	}
 }
 
+// RetryableError is an error TX commands may be retried on, with the name
+// it's given by users
+type RetryableError struct {
+	Name string
+	Err  error
+}
+
+// RetryableErrors are the errors TX commands are retried on by default
+var RetryableErrors = []RetryableError{
+	{"dp-out-of-range", ErrDpOutOfRange},
+	{"busy", ErrBusyMRF},
+	{"busy-rx", ErrBusyMRFRX},
+	{"tx-lost", ErrTxMsgLost},
+	{"no-ack", ErrNoAck},
+}
+
 func retryableError(err error) bool {
-	return errors.Is(err, ErrDpOutOfRange) ||
-		errors.Is(err, ErrBusyMRF) ||
-		errors.Is(err, ErrBusyMRFRX) ||
-		errors.Is(err, ErrTxMsgLost) ||
-		errors.Is(err, ErrNoAck)
+	for _, r := range RetryableErrors {
+		if errors.Is(err, r.Err) {
+			return true
+		}
+	}
+	return false
 }
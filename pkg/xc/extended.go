@@ -4,29 +4,40 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"os"
 	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
-type stickDplReader struct {
+// stickReader reads lists from the CI eprom; the first read requests the
+// list, subsequent reads read from the eprom at the current position.
+type stickReader struct {
+	ctx      context.Context
 	i        *Interface
+	request  byte
+	response byte
 	position uint32
 }
 
-func (d *stickDplReader) Read(p []byte) (n int, err error) {
+func (d *stickReader) Read(p []byte) (n int, err error) {
 	var data []byte
 	if d.position == 0 {
-		if data, err = d.i.sendExtendedCommand([]byte{MCI_ET_REQU_DPL, 0, 0, 0, 0, 0, 0}); err != nil {
+		request := mci.Extended{Command: d.request, Data: []byte{0, 0, 0, 0, 0, 0}}
+		if data, err = d.i.sendExtendedCommand(d.ctx, request); err != nil {
 			return 0, err
 		}
-		if data[0] != MCI_ET_SEND_DPL {
+		if data[0] != d.response {
 			return 0, errUnexpectedReponse
 		}
 	} else {
 		address := []byte{0, 0, 0, 0, 10, 0}
 		binary.LittleEndian.PutUint32(address, d.position)
-		if data, err = d.i.sendExtendedCommand(append([]byte{MCI_ET_RD}, address...)); err != nil {
+		request := mci.Extended{Command: MCI_ET_RD, Data: address}
+		if data, err = d.i.sendExtendedCommand(d.ctx, request); err != nil {
 			return 0, err
 		}
 		if data[0] != MCI_ET_REPLY {
@@ -34,13 +45,18 @@ func (d *stickDplReader) Read(p []byte) (n int, err error) {
 		}
 	}
 
-	copied := copy(p, data[7:])
-	d.position = binary.LittleEndian.Uint32(data[1:5]) + uint32(copied)
+	address, block, err := mci.Extended{Command: data[0], Data: data[1:]}.Block()
+	if err != nil {
+		return 0, err
+	}
+
+	copied := copy(p, block)
+	d.position = address + uint32(copied)
 
 	return copied, nil
 }
 
-func (d *stickDplReader) Seek(offset int64, whence int) (int64, error) {
+func (d *stickReader) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
 	case io.SeekStart:
 		d.position = uint32(offset)
@@ -51,7 +67,156 @@ func (d *stickDplReader) Seek(offset int64, whence int) (int64, error) {
 	return int64(d.position), nil
 }
 
+// recordingReader records everything read through it at the position it was
+// read from, reconstructing the image that was read.
+type recordingReader struct {
+	r        io.ReadSeeker
+	position int64
+	image    []byte
+	// Whether each byte of image has been read
+	read []bool
+}
+
+func (r *recordingReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+
+	if end := int(r.position) + n; end > len(r.image) {
+		r.image = append(r.image, make([]byte, end-len(r.image))...)
+		r.read = append(r.read, make([]bool, end-len(r.read))...)
+	}
+	copy(r.image[r.position:], p[:n])
+	for j := 0; j < n; j++ {
+		r.read[int(r.position)+j] = true
+	}
+	r.position += int64(n)
+
+	return
+}
+
+// fill reads the gaps between the parts that have been read, e.g. padding
+// the DPL reader skips over, so that the image is a complete copy up to the
+// furthest byte read
+func (r *recordingReader) fill() error {
+	for start := 0; start < len(r.read); {
+		if r.read[start] {
+			start++
+			continue
+		}
+
+		end := start
+		for end < len(r.read) && !r.read[end] {
+			end++
+		}
+
+		if _, err := r.Seek(int64(start), io.SeekStart); err != nil {
+			return err
+		}
+		n, err := r.Read(make([]byte, end-start))
+		if err != nil {
+			return fmt.Errorf("reading DPL at offset %d: %w", start, err)
+		} else if n == 0 {
+			return fmt.Errorf("reading DPL at offset %d: %w", start, io.ErrUnexpectedEOF)
+		}
+	}
+
+	return nil
+}
+
+func (r *recordingReader) Seek(offset int64, whence int) (int64, error) {
+	position, err := r.r.Seek(offset, whence)
+	r.position = position
+	return position, err
+}
+
+// DPLImage returns a copy of the raw datapoint list last read from the
+// eprom, or nil if none has been read.  The image covers the eprom from the
+// start to the end of the last part of the DPL.
+func (i *Interface) DPLImage() []byte {
+	i.extendedMutex.Lock()
+	defer i.extendedMutex.Unlock()
+
+	return append([]byte(nil), i.dplImage...)
+}
+
+// SaveDPL writes the raw datapoint list last read from the eprom to file,
+// which can be read back with --file.
+func (i *Interface) SaveDPL(filename string) error {
+	image := i.DPLImage()
+	if image == nil {
+		return errors.New("no datapoint list read from eprom")
+	}
+
+	return writeDPL(filename, image)
+}
+
+// SetDPLCache sets a file that the datapoint list is saved to whenever it's
+// read from the eprom, and which is read instead if the CI doesn't support
+// extended commands.
+func (i *Interface) SetDPLCache(filename string) {
+	i.dplCache = filename
+}
+
+func writeDPL(filename string, image []byte) error {
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, image, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// RequestDPL reads the datapoint list from the eprom and replaces the
+// current datapoints with it, merged with any read from file and after
+// applying any overrides.
 func (i *Interface) RequestDPL(ctx context.Context) error {
+	_, err := i.requestDPL(ctx)
+	return err
+}
+
+// scheduleDPLRefresh rereads the datapoint list from the eprom in the
+// background, unless it wasn't read from there to begin with.  Requests
+// made while a refresh is running are coalesced into one refresh after it.
+func (i *Interface) scheduleDPLRefresh(ctx context.Context) {
+	if !i.dplFromEprom.Load() {
+		return
+	}
+
+	i.refreshMutex.Lock()
+	defer i.refreshMutex.Unlock()
+
+	if i.refreshRunning {
+		i.refreshPending = true
+		return
+	}
+	i.refreshRunning = true
+
+	go func() {
+		for {
+			log.Println("Rereading datapoint list")
+			i.refreshDPL(ctx)
+
+			i.refreshMutex.Lock()
+			if !i.refreshPending {
+				i.refreshRunning = false
+				i.refreshMutex.Unlock()
+				return
+			}
+			i.refreshPending = false
+			i.refreshMutex.Unlock()
+		}
+	}()
+}
+
+// refreshDPL rereads the datapoint list from the eprom, and notifies the
+// handler of the changes, if any
+func (i *Interface) refreshDPL(ctx context.Context) {
+	if diff, err := i.requestDPL(ctx); err != nil {
+		log.Println(err)
+	} else if !diff.IsEmpty() {
+		i.handler.DPLChanged(diff)
+	}
+}
+
+func (i *Interface) requestDPL(ctx context.Context) (DPLDiff, error) {
 	start := time.Now()
 
 	if i.verbose {
@@ -61,25 +226,78 @@ func (i *Interface) RequestDPL(ctx context.Context) error {
 	i.extendedMutex.Lock()
 	defer i.extendedMutex.Unlock()
 
-	devs, dps, err := i.dplReader(&stickDplReader{i, 0})
+	recorder := &recordingReader{r: &stickReader{ctx, i, MCI_ET_REQU_DPL, MCI_ET_SEND_DPL, 0}}
+	_, dps, err := i.dplReader(recorder)
 	if err != nil {
 		if errors.Is(err, ErrUnknown) {
+			if i.dplCache != "" {
+				log.Printf("Warning: CI doesn't support extended commands, "+
+					"reading datapoints from cached copy %s", i.dplCache)
+				return i.requestCachedDPL(ctx)
+			}
 			log.Printf("Warning: CI doesn't support extended commands, " +
 				"cannot read datapoints from eprom. Must use file instead.")
-			return nil
+			return DPLDiff{}, nil
 		}
-		return err
+		return DPLDiff{}, err
 	}
-
-	done := make(chan bool, 1)
-	i.setupChan <- datapoints{devs, dps, done}
+	if err := recorder.fill(); err != nil {
+		return DPLDiff{}, err
+	}
+	i.dplImage = recorder.image
+	i.dplFromEprom.Store(true)
 
 	log.Printf("Read datapoint list from eprom in %s", time.Since(start))
 
+	if i.dplCache != "" {
+		if err := writeDPL(i.dplCache, i.dplImage); err != nil {
+			log.Printf("Warning: failed to cache datapoint list: %v", err)
+		}
+	}
+
+	i.layerMutex.Lock()
+	defer i.layerMutex.Unlock()
+
+	devs, dps := i.setEpromLayer(dps)
+	return i.setup(ctx, devs, dps), nil
+}
+
+func (i *Interface) requestCachedDPL(ctx context.Context) (DPLDiff, error) {
+	f, err := os.Open(i.dplCache)
+	if err != nil {
+		return DPLDiff{}, err
+	}
+	defer f.Close()
+
+	_, dps, err := i.dplReader(f)
+	if err != nil {
+		return DPLDiff{}, err
+	}
+
+	i.layerMutex.Lock()
+	defer i.layerMutex.Unlock()
+
+	devs, dps := i.setEpromLayer(dps)
+	return i.setup(ctx, devs, dps), nil
+}
+
+// setup applies overrides and hands over a new set of devices and
+// datapoints to the event loop, returning the changes from the previous set.
+// layerMutex must be held.
+func (i *Interface) setup(ctx context.Context, devs map[int]*Device, dps map[byte]*Datapoint) DPLDiff {
+	i.applyOverrides(devs, dps)
+
+	done := make(chan DPLDiff, 1)
 	select {
-	case <-ctx.Done():
-	case <-done:
+	case i.setupChan <- datapoints{devs, dps, done}:
+	case <-i.stopping:
+		return DPLDiff{}
 	}
 
-	return nil
+	select {
+	case <-ctx.Done():
+		return DPLDiff{}
+	case diff := <-done:
+		return diff
+	}
 }
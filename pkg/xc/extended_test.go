@@ -0,0 +1,141 @@
+package xc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+)
+
+func TestRecordingReaderGaps(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	recorder := &recordingReader{r: bytes.NewReader(data)}
+
+	// Read the start, skip a gap and read up to the end
+	if _, err := recorder.Read(make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recorder.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recorder.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recorder.fill(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recorder.image, data[:12]) {
+		t.Fatalf("image is %q, expected %q", recorder.image, data[:12])
+	}
+}
+
+func TestRecordingReaderFill(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample.dpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	recorder := &recordingReader{r: bytes.NewReader(data)}
+	if _, _, err := i.dplReader(recorder); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.fill(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(recorder.image, data[:len(recorder.image)]) {
+		t.Fatal("image differs from the DPL read")
+	}
+	for j, read := range recorder.read {
+		if !read {
+			t.Fatalf("byte %d not read", j)
+		}
+	}
+
+	// The image reads back as the same DPL
+	_, expected, err := i.dplReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dps, err := i.dplReader(bytes.NewReader(recorder.image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := diffDatapoints(expected, dps); !diff.IsEmpty() {
+		t.Fatalf("image reads back with changes %+v", diff)
+	}
+}
+
+func TestDPLImageCopy(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	i.dplImage = []byte{1, 2, 3}
+	image := i.DPLImage()
+	image[0] = 0
+
+	if i.dplImage[0] != 1 {
+		t.Fatal("DPLImage returned the internal image")
+	}
+}
+
+// expectExtended waits for an EXTENDED request to be sent to ci, and
+// answers it as a CI without extended command support
+func expectExtended(t *testing.T, ci *fakeCI) {
+	t.Helper()
+
+	select {
+	case frame := <-ci.written:
+		if frame[1] != MCI_PT_EXTENDED {
+			t.Fatalf("sent [% x], expected EXTENDED", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no EXTENDED request")
+	}
+	ci.send(t, mci.Status{Status: MCI_STT_ERROR, Data: []byte{MCI_STS_UNKNOWN, 0}})
+}
+
+func expectNothing(t *testing.T, ci *fakeCI) {
+	t.Helper()
+
+	select {
+	case frame := <-ci.written:
+		t.Fatalf("sent [% x]", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDPLRefresh(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	// Not read from the stick, so not reread
+	i.scheduleDPLRefresh(ctx)
+	expectNothing(t, ci)
+
+	i.dplFromEprom.Store(true)
+
+	// Requests while a refresh is running give one more refresh
+	for j := 0; j < 5; j++ {
+		i.scheduleDPLRefresh(ctx)
+	}
+	expectExtended(t, ci)
+	expectExtended(t, ci)
+	expectNothing(t, ci)
+}
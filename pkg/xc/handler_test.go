@@ -0,0 +1,20 @@
+package xc
+
+// nopHandler ignores all callbacks
+type nopHandler struct{}
+
+func (nopHandler) StatusValue(datapoint *Datapoint, value int)                     {}
+func (nopHandler) StatusBool(datapoint *Datapoint, on bool)                        {}
+func (nopHandler) StatusShutter(datapoint *Datapoint, status ShutterStatus)        {}
+func (nopHandler) Event(datapoint *Datapoint, event Event)                         {}
+func (nopHandler) Wheel(datapoint *Datapoint, value interface{})                   {}
+func (nopHandler) Valve(datapoint *Datapoint, position int)                        {}
+func (nopHandler) ValueEvent(datapoint *Datapoint, event Event, value interface{}) {}
+func (nopHandler) Value(datapoint *Datapoint, value interface{})                   {}
+func (nopHandler) Battery(device *Device, percentage int)                          {}
+func (nopHandler) Power(device *Device, value interface{})                         {}
+func (nopHandler) InternalTemperature(device *Device, centigrade int)              {}
+func (nopHandler) Rssi(device *Device, rssi int)                                   {}
+func (nopHandler) DPLChanged(diff DPLDiff)                                         {}
+func (nopHandler) SensorAssigned(number int)                                       {}
+func (nopHandler) UnknownTraffic(entry UnknownTraffic)                             {}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/binary"
 	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
 /* New heating actuator output channels:
@@ -65,7 +67,7 @@ func (d *Device) extendedStatusHeatingActuator(h Handler, data []byte) {
 }
 
 func (d *Datapoint) DesiredTemperature(ctx context.Context,
-	value float32) ([]byte, error) {
+	value float32) (TxResult, error) {
 
 	d.queue.Lock()
 	defer d.queue.Unlock()
@@ -80,17 +82,15 @@ func (d *Datapoint) DesiredTemperature(ctx context.Context,
 
 	binary.BigEndian.PutUint16(data, uint16(value*10))
 
-	return d.device.iface.sendTxCommand(ctx, []byte{
-		d.number,
-		MCI_TE_DIMPLEX_CONFIG,
-		data[0],
-		data[1],
-		MCI_TED_DPLMODE_CMF_EXT,
+	return d.device.iface.sendTxCommand(ctx, mci.TX{
+		Datapoint: d.number,
+		Event:     MCI_TE_DIMPLEX_CONFIG,
+		Data:      []byte{data[0], data[1], MCI_TED_DPLMODE_CMF_EXT},
 	})
 }
 
 func (d *Datapoint) CurrentTemperature(ctx context.Context,
-	value float32) ([]byte, error) {
+	value float32) (TxResult, error) {
 
 	d.queue.Lock()
 	defer d.queue.Unlock()
@@ -105,10 +105,9 @@ func (d *Datapoint) CurrentTemperature(ctx context.Context,
 
 	binary.BigEndian.PutUint16(data, uint16(value*10))
 
-	return d.device.iface.sendTxCommand(ctx, []byte{
-		d.number,
-		MCI_TE_DIMPLEX_TEMP,
-		data[0],
-		data[1],
+	return d.device.iface.sendTxCommand(ctx, mci.TX{
+		Datapoint: d.number,
+		Event:     MCI_TE_DIMPLEX_TEMP,
+		Data:      []byte{data[0], data[1]},
 	})
 }
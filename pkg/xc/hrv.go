@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/binary"
 	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
 func (d *Datapoint) AsyncDesiredTemperature(value float32) {
@@ -36,11 +38,11 @@ func (d *Datapoint) asyncSendTemperatures(ctx context.Context,
 	binary.BigEndian.PutUint16(setpoint, uint16(desiredTemperature*10))
 	binary.BigEndian.PutUint16(current, uint16(currentTemperature*10))
 
-	if _, err := d.device.iface.sendTxCommand(ctx, []byte{
-		d.number,
-		MCI_TE_HRV_IN,
-		setpoint[0], setpoint[1],
-		current[0], current[1],
+	// Replies to the HRV are not user initiated, don't delay other commands
+	if _, err := d.device.iface.sendTxCommand(WithPriority(ctx, PriorityBackground), mci.TX{
+		Datapoint: d.number,
+		Event:     MCI_TE_HRV_IN,
+		Data:      []byte{setpoint[0], setpoint[1], current[0], current[1]},
 	}); err != nil {
 		log.Printf("WARNING: command for datapoint %d failed: %v", d.number, err)
 	}
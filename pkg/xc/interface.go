@@ -2,8 +2,10 @@ package xc
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"golang.org/x/sync/semaphore"
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
 // Interface
@@ -13,7 +15,9 @@ type Interface struct {
 
 	// tx command queue
 	txCommandChan chan request
-	txSemaphore   *semaphore.Weighted
+	txScheduler   *txScheduler
+	timeaccount   *timeaccount
+	retryPolicy   RetryPolicy
 
 	// config command queue
 	configCommandChan chan request
@@ -22,8 +26,39 @@ type Interface struct {
 	// extended command queue
 	extendedCommandChan chan request
 	extendedMutex       sync.Mutex
+	dplImage            []byte
+	dplCache            string
 
-	setupChan chan datapoints
+	// the datapoint list has been read from the stick, so is reread when
+	// it changes there, one refresh at a time
+	dplFromEprom   atomic.Bool
+	refreshMutex   sync.Mutex
+	refreshRunning bool
+	refreshPending bool
+
+	// datapoints read from eprom and file, merged into datapoints; the
+	// mutex is held until the merged list is handed to the event loop, so
+	// that lists are applied in the order they're merged
+	layerMutex sync.Mutex
+	epromLayer map[byte]*Datapoint
+	fileLayer  map[byte]*Datapoint
+
+	overrides map[byte]Override
+
+	// the status list is reread a while after it changes
+	stlMutex   sync.Mutex
+	stlRefresh *time.Timer
+	stlDelay   time.Duration
+
+	setupChan  chan datapoints
+	statusChan chan statusList
+
+	// closed when the event loop stops accepting commands
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+
+	rejectedFrames atomic.Uint64
+	unknownTraffic unknownTraffic
 
 	verbose bool
 	handler Handler
@@ -78,7 +113,11 @@ type Handler interface {
 	// Rssi updated
 	Rssi(device *Device, rssi int)
 	// Datapoint list changed
-	DPLChanged()
+	DPLChanged(diff DPLDiff)
+	// Sensor assigned to datapoint while CI was in learn mode
+	SensorAssigned(number int)
+	// New kind of, or new sample of, traffic that couldn't be decoded
+	UnknownTraffic(entry UnknownTraffic)
 }
 
 // Device returns the device with the specified serialNumber
@@ -114,14 +153,22 @@ func (i *Interface) ForEachDevice(devfunc func(*Device) error) error {
 }
 
 type request struct {
-	command    []byte
-	responseCh chan []byte
+	packet     mci.Packet
+	responseCh chan response
+}
+
+// response is the status or extended message a command was answered with,
+// without the packet type, or err if it couldn't be sent.  Both are nil
+// if the event loop stopped first.
+type response struct {
+	data []byte
+	err  error
 }
 
 type datapoints struct {
 	devices    map[int]*Device
 	datapoints map[byte]*Datapoint
-	done       chan bool
+	done       chan DPLDiff
 }
 
 // Init loads datapoints from the specified file and takes a handler which
@@ -134,11 +181,17 @@ func (i *Interface) Init(handler Handler, verbose bool) {
 	i.verbose = verbose
 
 	// Only allow four tx commands in parallel
-	i.txSemaphore = semaphore.NewWeighted(4)
+	i.txScheduler = newTxScheduler(4)
+	i.timeaccount = newTimeaccount()
+	i.retryPolicy = DefaultRetryPolicy()
 	i.txCommandChan = make(chan request)
 
 	i.configCommandChan = make(chan request)
 	i.extendedCommandChan = make(chan request)
 
 	i.setupChan = make(chan datapoints)
+	i.statusChan = make(chan statusList)
+	i.stlDelay = stlRefreshDelay
+
+	i.stopping = make(chan struct{})
 }
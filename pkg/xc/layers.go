@@ -0,0 +1,125 @@
+package xc
+
+/* The datapoint list is merged from the list read from the eprom, or its
+   cached copy, with the list read from file on top.  The file can rename
+   datapoints from the eprom, by giving them another name, and add
+   datapoints missing from it.  Overrides are applied to the merged list. */
+
+// setEpromLayer replaces the datapoints read from the eprom, and returns
+// the merged datapoint list.  layerMutex must be held.
+func (i *Interface) setEpromLayer(datapoints map[byte]*Datapoint) (map[int]*Device, map[byte]*Datapoint) {
+	i.epromLayer = datapoints
+	return i.mergeLayers(i.epromLayer, i.fileLayer)
+}
+
+// setFileLayer replaces the datapoints read from file, and returns the
+// merged datapoint list.  layerMutex must be held.
+func (i *Interface) setFileLayer(datapoints map[byte]*Datapoint) (map[int]*Device, map[byte]*Datapoint) {
+	i.fileLayer = datapoints
+	return i.mergeLayers(i.epromLayer, i.fileLayer)
+}
+
+// mergeLayers returns a copy of the datapoints in layers, with datapoints
+// in later layers replacing those with the same number in earlier layers.
+// Device details are also taken from the latest layer with the device.
+func (i *Interface) mergeLayers(layers ...map[byte]*Datapoint) (map[int]*Device, map[byte]*Datapoint) {
+	devices := make(map[int]*Device)
+	datapoints := make(map[byte]*Datapoint)
+
+	for l := len(layers) - 1; l >= 0; l-- {
+		for n := 0; n < 256; n++ {
+			dp, exists := layers[l][byte(n)]
+			if !exists {
+				continue
+			} else if _, exists := datapoints[dp.number]; exists {
+				continue
+			}
+
+			device, exists := devices[dp.device.serialNumber]
+			if !exists {
+				device = &Device{
+					deviceType:   dp.device.deviceType,
+					subtype:      dp.device.subtype,
+					serialNumber: dp.device.serialNumber,
+					name:         dp.device.name,
+					location:     dp.device.location,
+					swVersion:    dp.device.swVersion,
+					iface:        i,
+				}
+				devices[device.serialNumber] = device
+			}
+
+			merged := &Datapoint{
+				device:   device,
+				name:     dp.name,
+				number:   dp.number,
+				channel:  dp.channel,
+				mode:     dp.mode,
+				sensor:   dp.sensor,
+				location: dp.location,
+			}
+			device.datapoints = append(device.datapoints, merged)
+			datapoints[merged.number] = merged
+		}
+	}
+
+	return devices, datapoints
+}
+
+// keepRuntimeState returns the new datapoint list, with the devices and
+// datapoints that were already known updated in place rather than replaced,
+// and the changes from the current list.  This keeps what has been learned
+// about them at runtime, such as RSSI, battery and subtype, and their TX
+// queues, which commands in flight hold.  A device is only kept if its type
+// is unchanged, and a datapoint only if its device is kept.
+func (i *Interface) keepRuntimeState(devices map[int]*Device, datapoints map[byte]*Datapoint) (map[int]*Device, map[byte]*Datapoint, DPLDiff) {
+	// Compared before the datapoints are updated in place
+	diff := diffDatapoints(i.datapoints, datapoints)
+
+	keptDevices := make(map[int]*Device)
+	for serial, device := range devices {
+		if old, exists := i.devices[serial]; exists && old.deviceType == device.deviceType {
+			old.name = device.name
+			old.location = device.location
+			if device.swVersion != "" {
+				old.swVersion = device.swVersion
+			}
+			device = old
+		}
+		device.datapoints = nil
+		keptDevices[serial] = device
+	}
+
+	keptDatapoints := make(map[byte]*Datapoint)
+	for n := 0; n < 256; n++ {
+		dp, exists := datapoints[byte(n)]
+		if !exists {
+			continue
+		}
+
+		device := keptDevices[dp.device.serialNumber]
+		if old, exists := i.datapoints[dp.number]; exists && old.device == device {
+			old.name = dp.name
+			old.channel = dp.channel
+			old.mode = dp.mode
+			old.sensor = dp.sensor
+			old.location = dp.location
+			dp = old
+		} else {
+			dp.device = device
+		}
+
+		device.datapoints = append(device.datapoints, dp)
+		keptDatapoints[dp.number] = dp
+	}
+
+	// Report the datapoints in use, rather than those they were updated from
+	for j := range diff.Added {
+		diff.Added[j] = keptDatapoints[diff.Added[j].number]
+	}
+	for j := range diff.Changed {
+		diff.Changed[j] = keptDatapoints[diff.Changed[j].number]
+	}
+
+	return keptDevices, keptDatapoints, diff
+}
@@ -0,0 +1,148 @@
+package xc
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMergeLayers(t *testing.T) {
+	i := &Interface{}
+
+	_, eprom, err := i.dplReader(bytes.NewReader(readSample(t, "testdata/sample.dpl")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, file, err := i.txtReader(strings.NewReader(
+		"2\tDimmer (Dining table)\t2345678\t17\t0\t0\t0\t0\t\r\n" +
+			"5\tGarage door\t4567890\t18\t0\t0\t0\t0\t\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i.layerMutex.Lock()
+	i.setFileLayer(file)
+	devices, datapoints := i.setEpromLayer(eprom)
+	i.layerMutex.Unlock()
+	checkDatapoints(t, devices, datapoints)
+
+	if len(datapoints) != 5 {
+		t.Fatalf("merged %d datapoints, expected 5", len(datapoints))
+	}
+	if name := datapoints[2].Name(); name != "Dimmer (Dining table)" {
+		t.Errorf("datapoint 2 named '%s', expected the name from file", name)
+	}
+	if name := datapoints[1].Name(); name != "Ceiling" {
+		t.Errorf("datapoint 1 named '%s', expected the name from eprom", name)
+	}
+	if datapoints[5] == nil || devices[4567890] == nil {
+		t.Errorf("datapoint 5 not added from file")
+	}
+
+	// The layers are left as read
+	if eprom[2].Name() != "Sofa" || eprom[2].device == datapoints[2].device {
+		t.Errorf("eprom layer changed by merging")
+	}
+}
+
+func TestKeepRuntimeState(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	devices, datapoints, err := i.dplReader(bytes.NewReader(readSample(t, "testdata/sample.dpl")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.devices, i.datapoints, _ = i.keepRuntimeState(devices, datapoints)
+
+	dimmer := i.datapoints[2]
+	dimmer.device.rssi = 50
+	dimmer.device.subtype = 3
+
+	// Datapoint 2 renamed, 1 moved to another device type, 4 removed
+	_, reloaded, err := i.txtReader(strings.NewReader(
+		"1\tCeiling\t1234567\t18\t0\t0\t0\t0\t\r\n" +
+			"2\tDimmer (Dining table)\t2345678\t17\t0\t0\t0\t0\t\r\n" +
+			"3\tBathroom\t3456789\t21\t0\t0\t0\t0\t\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := i.datapoints
+	devices, datapoints = i.mergeLayers(reloaded)
+	var diff DPLDiff
+	i.devices, i.datapoints, diff = i.keepRuntimeState(devices, datapoints)
+	checkDatapoints(t, i.devices, i.datapoints)
+
+	// The changes are reported with the datapoints in use
+	if len(diff.Changed) != 3 || len(diff.Removed) != 1 {
+		t.Fatalf("got changes %s, expected 1-3 changed and 4 removed", diff)
+	}
+	for _, dp := range diff.Changed {
+		if i.datapoints[dp.number] != dp || i.devices[dp.device.serialNumber] != dp.device {
+			t.Errorf("datapoint %d reported as changed isn't the one in use", dp.number)
+		}
+	}
+
+	if i.datapoints[2] != dimmer {
+		t.Fatal("datapoint 2 replaced")
+	}
+	if dimmer.Name() != "Dimmer (Dining table)" || dimmer.device.rssi != 50 || dimmer.device.subtype != 3 {
+		t.Errorf("datapoint 2 is %+v on %+v, expected the new name and the old RSSI and subtype",
+			dimmer, dimmer.device)
+	}
+	if i.datapoints[1] == old[1] || i.datapoints[1].device.deviceType != 18 {
+		t.Errorf("datapoint 1 kept, although its device type changed")
+	}
+	if i.datapoints[3] != old[3] {
+		t.Errorf("datapoint 3 replaced")
+	}
+	if _, exists := i.datapoints[4]; exists {
+		t.Errorf("datapoint 4 not removed")
+	}
+}
+
+func TestConcurrentLayerUpdates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filename, []byte("5\tGarage door\t4567890\t18\t0\t0\t0\t0\t\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+	i.dplCache = "testdata/sample.dpl"
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	for j := 0; j < 20; j++ {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := i.requestCachedDPL(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := i.ReloadFile(ctx, filename); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		// Whichever was applied last has both layers
+		if len(i.datapoints) != 5 {
+			t.Fatalf("%d datapoints after updating both layers, expected 5", len(i.datapoints))
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package xc
+
+import "strings"
+
+// Location is the placement of a datapoint in the building, as configured
+// in the MRF software.  Fields are empty if not set.
+type Location struct {
+	Building string `json:"building,omitempty"`
+	Floor    string `json:"floor,omitempty"`
+	Room     string `json:"room,omitempty"`
+}
+
+func (l Location) IsZero() bool {
+	return l == Location{}
+}
+
+func (l Location) String() string {
+	var parts []string
+	for _, p := range []string{l.Building, l.Floor, l.Room} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -3,152 +3,250 @@ package xc
 import (
 	"context"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
 	"time"
 
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
 	"github.com/pkg/errors"
 )
 
-const (
-	commandRetries     = 2
-	lostCommandTimeout = 10
-)
+const shutdownTimeout = 5 * time.Second
 
 // Run starts the event loop, dispatching TX and CONFIG commands,
-// and returning the results to the requesters.
+// and returning the results to the requesters.  When ctx is cancelled,
+// new commands are rejected with ErrShuttingDown, and Run waits up to
+// shutdownTimeout for outstanding TX commands to be acknowledged before
+// returning.  conn must remain usable until Run returns.  Run must only be
+// called once; commands are rejected with ErrShuttingDown once it has
+// stopped, so use a new Interface for a new connection.
 func (i *Interface) Run(ctx context.Context, conn io.ReadWriter) error {
 	input := make(chan []byte)
-	ctx, cancel := context.WithCancel(ctx)
+	readFailed := make(chan struct{})
 
 	out := prependLength{conn}
 
 	go func() {
-		defer cancel()
+		defer close(readFailed)
 		buf := make([]byte, 256)
 		for {
-			if n, err := conn.Read(buf); err != nil {
+			if n, err := conn.Read(buf); errors.Is(err, ErrStartStopByte) {
+				// Framing lost; keep reading until the next start byte
+				i.reject(buf[:n], err)
+			} else if err != nil {
 				log.Printf("read failed: %+v", errors.WithStack(err))
 				return
 			} else if n > 0 {
-				if buf[0] > 0 {
-					input <- buf[1:buf[0]]
-				} else {
-					log.Printf("Ignoring unexpected input [%s]", hex.EncodeToString(buf[:n]))
+				length := int(buf[0])
+				if length == 0 || length > n {
+					i.reject(buf[:n], errors.Errorf("length %d, read %d bytes", length, n))
+					continue
 				}
+
+				// Copy, since buf is reused for the next read
+				frame := make([]byte, length-1)
+				copy(frame, buf[1:length])
+				input <- frame
 			}
 		}
 	}()
 
 	var txWaiters waithandler
-	var configWaiter, extendedWaiter chan []byte
+	var configWaiter, extendedWaiter chan response
+	// the command configWaiter is waiting for a response to
+	var configCommand byte
+
+	txCommandChan := i.txCommandChan
+	configCommandChan := i.configCommandChan
+	extendedCommandChan := i.extendedCommandChan
+	// nil if ctx can't be cancelled, in which case Run only returns if
+	// reading fails
+	stop := ctx.Done()
+	draining := false
+	var drainTimeout <-chan time.Time
 
 	defer func() {
+		i.stop()
 		txWaiters.Close()
 		if configWaiter != nil {
-			configWaiter <- nil
+			configWaiter <- response{}
 		}
 		if extendedWaiter != nil {
-			extendedWaiter <- nil
+			extendedWaiter <- response{}
 		}
 	}()
 
 	for {
+		if draining && txWaiters.Len() == 0 {
+			log.Println("Exiting")
+			return nil
+		}
+
 		select {
 		case o := <-i.setupChan:
-			i.devices = o.devices
-			i.datapoints = o.datapoints
+			var diff DPLDiff
+			i.devices, i.datapoints, diff = i.keepRuntimeState(o.devices, o.datapoints)
+			o.done <- diff
+
+		case o := <-i.statusChan:
+			i.applyStatusList(o.entries)
 			o.done <- true
 
-		case o := <-i.txCommandChan:
+		case o := <-txCommandChan:
 			// Send TX command
 			seq, waiters := txWaiters.Add(o.responseCh)
-			tx := append(o.command, byte(seq<<4))
+			tx := o.packet.(mci.TX)
+			tx.Seq = byte(seq)
+			frame, err := mci.Marshal(tx)
+			if err != nil {
+				txWaiters.Fail(err, seq)
+				break
+			}
 			if i.verbose {
 				log.Printf("TX (seq %x, %d parallel): [%s] ",
-					seq, waiters, hex.EncodeToString(tx))
+					seq, waiters, hex.EncodeToString(frame))
 			}
-			if _, err := out.Write(tx); err != nil {
+			if _, err := out.Write(frame); err != nil {
 				return errors.WithStack(err)
 			}
 
-		case o := <-i.configCommandChan:
+		case o := <-configCommandChan:
 			// Send CONFIG command
+			frame, err := mci.Marshal(o.packet)
+			if err != nil {
+				o.responseCh <- response{err: err}
+				break
+			}
 			configWaiter = o.responseCh
+			configCommand = o.packet.(mci.Config).Command
 			if i.verbose {
-				log.Printf("CONFIG: [%s]", hex.EncodeToString(o.command))
+				log.Printf("CONFIG: [%s]", hex.EncodeToString(frame))
 			}
-			if _, err := out.Write(o.command); err != nil {
+			if _, err := out.Write(frame); err != nil {
 				return errors.WithStack(err)
 			}
 
-		case o := <-i.extendedCommandChan:
+		case o := <-extendedCommandChan:
 			// Send EXTENDED command
+			frame, err := mci.Marshal(o.packet)
+			if err != nil {
+				o.responseCh <- response{err: err}
+				break
+			}
 			extendedWaiter = o.responseCh
 			if i.verbose {
-				log.Printf("EXTENDED: [%s]", hex.EncodeToString(o.command))
+				log.Printf("EXTENDED: [%s]", hex.EncodeToString(frame))
 			}
-			if _, err := out.Write(o.command); err != nil {
+			if _, err := out.Write(frame); err != nil {
 				return errors.WithStack(err)
 			}
 
 		case in := <-input:
-			switch in[0] {
-			case MCI_PT_RX:
+			packet, err := mci.Unmarshal(in)
+			if err != nil {
+				i.reject(in, err)
+				break
+			}
+
+			switch p := packet.(type) {
+			case mci.RX, mci.ExtendedStatus, mci.BasicMode:
 				if i.verbose {
 					log.Printf("RX: [%s]", hex.EncodeToString(in))
 				}
 
-				if err := i.rx(ctx, in[1:]); err != nil {
+				if err := i.rx(ctx, p); err != nil {
 					if errors.Is(err, errMsgNotHandled) {
 						log.Printf("Message not handled [%s]",
 							hex.EncodeToString(in))
+						i.recordUnknown(p, in, err)
+					} else if errors.Is(err, ErrMalformedMessage) {
+						i.reject(in, err)
 					} else {
 						return err
 					}
 				}
-			case MCI_PT_STATUS:
+			case mci.Status:
 				if i.verbose {
 					log.Printf("STATUS: [%s]", hex.EncodeToString(in))
 				}
 
-				switch in[1] {
-				case MCI_STT_ERROR:
-					seqPos := 3
+				// Waiters get the status without the packet type
+				status := in[1:]
+				code, _ := p.Code()
 
-					switch in[2] {
+				switch p.Status {
+				case MCI_STT_ERROR:
+					switch code {
 					case MCI_STS_UNKNOWN:
 						// If this fails, allocate seqno 0 to extended cmds only
 						if extendedWaiter != nil {
-							extendedWaiter <- in[1:]
+							extendedWaiter <- response{data: status}
 							extendedWaiter = nil
 						}
-					case MCI_STS_GENERAL:
-						seqPos = 4
-						fallthrough
 					default:
-						txWaiters.Resume(in[1:], int(in[seqPos]>>4))
+						if seq, ok := p.Seq(); ok {
+							txWaiters.Resume(status, int(seq))
+						} else {
+							log.Printf("Ignoring error status without sequence number [%s]", hex.EncodeToString(in))
+						}
 					}
 				case MGW_STT_OK:
-					switch in[2] {
+					switch code {
 					case STATUS_OK_MRF:
-						switch in[4] {
+						seq, ok := p.Seq()
+						if !ok || len(p.Data) < 3 {
+							log.Printf("Ignoring short OK_MRF status [%s]", hex.EncodeToString(in))
+							break
+						}
+
+						okStatus := p.Data[2]
+						switch okStatus &^ STATUS_DATA_OKMRF_DPREMOVED {
 						case STATUS_DATA_OKMRF_NOINFO,
 							STATUS_DATA_OKMRF_ACK_DIRECT,
-							STATUS_DATA_OKMRF_ACK_ROUTED:
-							txWaiters.Resume(in[1:], int(in[3]>>4))
+							STATUS_DATA_OKMRF_ACK_ROUTED,
+							STATUS_DATA_OKMRF_ACK,
+							STATUS_DATA_OKMRF_ACK_BM:
+						default:
+							log.Printf("Unknown OK_MRF status %02x, treating as no info", okStatus)
+						}
+						txWaiters.Resume(status, int(seq))
+						i.timeaccount.acknowledged()
+
+						if okStatus&STATUS_DATA_OKMRF_DPREMOVED != 0 {
+							log.Println("Datapoint has been removed from the stick")
+							i.scheduleDPLRefresh(ctx)
 						}
 					case STATUS_OK_CONFIG:
 						// doesn't matter what we return here
 						if configWaiter != nil {
-							configWaiter <- in[2:]
+							configWaiter <- response{data: p.Data}
 							configWaiter = nil
 						}
 					}
 				case MCI_STT_TIMEACCOUNT:
-					switch in[2] {
+					// Guessing the percentage would stop all TX if
+					// taken as zero
+					if len(p.Data) < 1 || (code == STATUS_DATA && len(p.Data) < 2) {
+						i.reject(in, errors.New("short timeaccount status"))
+						break
+					}
+					var percent byte
+					if code == STATUS_DATA {
+						percent = p.Data[1]
+					}
+					i.timeaccount.update(code, percent)
+
+					switch code {
 					case STATUS_DATA:
-						log.Printf("Timeaccount %d%%", in[3])
+						log.Printf("Timeaccount %d%%", percent)
+						// The stick also reports the timeaccount unasked,
+						// which isn't a response to other commands
+						if configWaiter != nil && configCommand == CONF_TIMEACCOUNT {
+							configWaiter <- response{data: p.Data}
+							configWaiter = nil
+						}
 					case STATUS_IS_0:
 						log.Printf("Timeaccount zero, no more transmission possible")
 					case STATUS_LESS_10:
@@ -157,129 +255,228 @@ func (i *Interface) Run(ctx context.Context, conn io.ReadWriter) error {
 						log.Printf("Timeaccount climbed above 15%%")
 					}
 				case MGW_STT_SERIAL,
+					MGW_STT_RS232_BAUD,
+					MGW_STT_RS232_FLOW,
+					MGW_STT_RS232_CRC,
 					MGW_STT_RELEASE,
 					MGW_STT_SEND_OK_MRF,
 					MCI_STT_COUNTER_RX,
 					MCI_STT_COUNTER_TX:
 					if configWaiter != nil {
-						configWaiter <- in[2:]
+						configWaiter <- response{data: p.Data}
 						configWaiter = nil
 					}
 				default:
 					log.Printf("<- %s", hex.EncodeToString(in))
+					i.recordUnknown(p, in, notHandled("unknown status"))
 				}
-			case MCI_PT_EXTENDED:
+			case mci.Extended:
 				if i.verbose {
 					log.Printf("EPROM: [%s]", hex.EncodeToString(in))
 				}
 
-				switch in[1] {
+				switch p.Command {
 				case MCI_ET_DPL_CHANGED:
-					go func() {
-						if err := i.RequestDPL(ctx); err != nil {
-							log.Println(err)
-						} else {
-							i.handler.DPLChanged()
-						}
-					}()
+					i.scheduleDPLRefresh(ctx)
 
-				case MCI_ET_REPLY, MCI_ET_SEND_DPL:
+				case MCI_ET_STL_CHANGED:
+					i.scheduleSTLRefresh(ctx)
+
+				case MCI_ET_REPLY, MCI_ET_SEND_DPL, MCI_ET_SEND_STL:
 					if extendedWaiter != nil {
-						extendedWaiter <- in[1:]
+						extendedWaiter <- response{data: in[1:]}
 						extendedWaiter = nil
 					}
 
-				case MCI_ET_STL_CHANGED, MCI_ET_SEND_STL:
-					log.Printf("Status list messages currently ignored: %02x", in[1])
-
 				default:
-					log.Printf("Unknown extended message received: %02x", in[1])
+					log.Printf("Unknown extended message received: %02x", p.Command)
+					i.recordUnknown(p, in, notHandled("unknown extended message"))
 				}
 
 			default:
 				log.Printf("Unknown message received: %s", hex.EncodeToString(in))
+				i.recordUnknown(p, in, notHandled("unknown message"))
 			}
 
-		case <-txWaiters.OldestExpiring(lostCommandTimeout):
+		case <-txWaiters.OldestExpiring(i.retryPolicy.TxTimeout):
 			log.Println("TX message was silently lost, likely never sent")
 			txWaiters.ResumeOldest([]byte{MCI_STT_ERROR, MCI_STS_NO_ACK})
 
-		case <-ctx.Done():
+		case <-stop:
+			// Stop accepting new commands, and wait for outstanding
+			// commands to complete
+			log.Printf("Stopping, waiting for %d outstanding commands", txWaiters.Len())
+			i.stop()
+			draining = true
+			stop = nil
+			txCommandChan = nil
+			configCommandChan = nil
+			extendedCommandChan = nil
+			drainTimeout = time.After(shutdownTimeout)
+
+		case <-drainTimeout:
+			log.Printf("Timed out waiting for %d outstanding commands", txWaiters.Len())
+			return nil
+
+		case <-readFailed:
 			log.Println("Exiting")
 			return nil
 		}
 	}
 }
 
-func (i *Interface) sendTxCommand(ctx context.Context, command []byte) ([]byte, error) {
-	if err := i.txSemaphore.Acquire(ctx, 1); err != nil {
-		return nil, errors.WithStack(err)
+// stop rejects new commands with ErrShuttingDown
+func (i *Interface) stop() {
+	i.stoppingOnce.Do(func() { close(i.stopping) })
+}
+
+// reject counts and logs a frame from the stick that couldn't be decoded
+func (i *Interface) reject(frame []byte, err error) {
+	count := i.rejectedFrames.Add(1)
+	log.Printf("Rejected malformed frame [%s] (%d rejected): %v",
+		hex.EncodeToString(frame), count, err)
+}
+
+// RejectedFrames returns the number of frames from the stick that were
+// rejected as malformed
+func (i *Interface) RejectedFrames() uint64 {
+	return i.rejectedFrames.Load()
+}
+
+// sendTxCommand sends a TX command once a slot is available, with the
+// priority set in ctx; see WithPriority
+func (i *Interface) sendTxCommand(ctx context.Context, tx mci.TX) (TxResult, error) {
+	var result TxResult
+	priority := priorityFromContext(ctx)
+
+	if err := i.waitTimeaccount(ctx, priority, tx.Datapoint); err != nil {
+		return result, err
 	}
-	defer i.txSemaphore.Release(1)
+	if err := i.txScheduler.Acquire(ctx, priority, tx.Datapoint); err != nil {
+		return result, errors.WithStack(err)
+	}
+	defer i.txScheduler.Release()
 
-	for retry := 0; ; retry++ {
-		waitCh := make(chan []byte)
-		i.txCommandChan <- request{append([]byte{byte(MCI_PT_TX)}, command...), waitCh}
-		res := <-waitCh
+	policy := &i.retryPolicy
+	start := time.Now()
+	for result.Retries = 0; ; result.Retries++ {
+		// Buffered, so the event loop doesn't block if we give up waiting
+		waitCh := make(chan response, 1)
+		select {
+		case i.txCommandChan <- request{tx, waitCh}:
+		case <-i.stopping:
+			return result, errors.WithStack(ErrShuttingDown)
+		case <-ctx.Done():
+			return result, errors.WithStack(ctx.Err())
+		}
+
+		// The frame is on its way to the stick, so wait for the event
+		// loop to resolve it, also when ctx is cancelled; it gives up
+		// after the TX timeout, or when it stops
+		reply := <-waitCh
+		if reply.err != nil {
+			return result, reply.err
+		}
+		res := reply.data
+		if res == nil {
+			return result, errors.WithStack(ErrShuttingDown)
+		}
 
 		if len(res) > 0 {
 			switch res[0] {
 			case MCI_STT_ERROR:
 				err := errorMessage(res[1:])
-				if retryableError(err) && retry < commandRetries {
+				if i.Timeaccount().Zero {
+					// Retrying won't help until the budget recovers
+					return result, errors.WithStack(fmt.Errorf("%w: %w", ErrTimeaccountZero, err))
+				}
+				if policy.Retryable(err) && result.Retries < policy.Retries {
 					log.Printf("TX command failed, retrying (%d/%d): %v",
-						retry+1, commandRetries, err)
+						result.Retries+1, policy.Retries, err)
+					if err := policy.backoff(ctx, result.Retries); err != nil {
+						return result, err
+					}
 					continue
 				}
-				return nil, errors.WithStack(err)
+				return result, errors.WithStack(err)
 			case MGW_STT_OK:
-				return res[1:], nil
+				if len(res) > 3 {
+					result.Ack, result.DatapointRemoved = parseOKMRF(res[3])
+				}
+				result.Latency = time.Since(start)
+				if result.DatapointRemoved {
+					return result, errors.WithStack(ErrDatapointRemoved)
+				}
+				return result, nil
 			}
 		}
 
-		return nil, errors.WithStack(ErrTerminal)
+		return result, errors.WithStack(ErrTerminal)
 	}
 }
 
-func (i *Interface) sendConfigCommand(command []byte) ([]byte, error) {
+func (i *Interface) sendConfigCommand(ctx context.Context, command mci.Config) ([]byte, error) {
 	i.configMutex.Lock()
 	defer i.configMutex.Unlock()
 
-	for {
-		waitCh := make(chan []byte)
-		i.configCommandChan <- request{append([]byte{byte(MCI_PT_CONFIG)}, command...), waitCh}
+	res, err := i.sendAwaitingResponse(ctx, i.configCommandChan, command)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, errors.WithStack(ErrTerminal)
+	}
 
-		select {
-		case res := <-waitCh:
-			if len(res) == 0 {
-				return nil, errors.WithStack(ErrTerminal)
-			}
+	return res, nil
+}
 
-			return res, nil
-		case <-time.After(5 * time.Second):
-			log.Println("Stick didn't respond after five seconds, retrying command")
-		}
+func (i *Interface) sendExtendedCommand(ctx context.Context, command mci.Extended) ([]byte, error) {
+	res, err := i.sendAwaitingResponse(ctx, i.extendedCommandChan, command)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 2 {
+		return nil, errors.WithStack(ErrTerminal)
+	}
+
+	if res[0] == MCI_STT_ERROR {
+		return nil, errors.WithStack(errorMessage(res[1:]))
 	}
+	return res, nil
 }
 
-func (i *Interface) sendExtendedCommand(command []byte) ([]byte, error) {
-	for {
-		waitCh := make(chan []byte)
-		i.extendedCommandChan <- request{append([]byte{byte(MCI_PT_EXTENDED)}, command...), waitCh}
+// sendAwaitingResponse sends a CONFIG or EXTENDED command, resending it
+// as set by the retry policy if the stick doesn't respond
+func (i *Interface) sendAwaitingResponse(ctx context.Context, ch chan request, command mci.Packet) ([]byte, error) {
+	policy := &i.retryPolicy
+	for retry := 0; ; retry++ {
+		// Buffered, so the event loop doesn't block if we give up waiting
+		waitCh := make(chan response, 1)
+		select {
+		case ch <- request{command, waitCh}:
+		case <-i.stopping:
+			return nil, errors.WithStack(ErrShuttingDown)
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		}
 
+		// Not giving up when ctx is cancelled, since the command has
+		// been sent and the event loop is waiting for the response
 		select {
 		case res := <-waitCh:
-			if len(res) < 2 {
-				return nil, errors.WithStack(ErrTerminal)
+			if res.err != nil {
+				return nil, res.err
 			}
-
-			if res[0] == MCI_STT_ERROR {
-				return nil, errors.WithStack(errorMessage(res[1:]))
+			if res.data == nil {
+				// The event loop stopped before the stick responded
+				return nil, errors.WithStack(ErrShuttingDown)
 			}
-			return res, nil
-
-		case <-time.After(5 * time.Second):
-			log.Println("Stick didn't respond after five seconds, retrying command")
+			return res.data, nil
+		case <-time.After(policy.ResponseTimeout):
+			if !policy.resend(retry) {
+				return nil, errors.WithStack(ErrNoResponse)
+			}
+			log.Printf("Stick didn't respond after %s, retrying command", policy.ResponseTimeout)
 		}
 	}
 }
@@ -0,0 +1,210 @@
+package xc
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
+)
+
+// pipeConn is a CI connection reading from a pipe, discarding anything
+// written
+type pipeConn struct {
+	io.Reader
+}
+
+func (pipeConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestRunWithoutCancel(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- i.Run(context.Background(), pipeConn{r})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return when reading failed")
+	}
+
+	select {
+	case <-i.stopping:
+	default:
+		t.Fatal("stopping not closed")
+	}
+}
+
+func TestRunAgain(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	for j := 0; j < 2; j++ {
+		r, w := io.Pipe()
+		w.Close()
+		if err := i.Run(context.Background(), pipeConn{r}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := i.Serial(context.Background()); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("got %v, expected ErrShuttingDown", err)
+	}
+}
+
+// fakeCI passes frames written by the interface on to a channel, and
+// frames sent with send to the interface.  Frames include the length byte.
+type fakeCI struct {
+	io.Reader
+	w       *io.PipeWriter
+	written chan []byte
+}
+
+func newFakeCI() *fakeCI {
+	r, w := io.Pipe()
+	return &fakeCI{Reader: r, w: w, written: make(chan []byte, 16)}
+}
+
+func (f *fakeCI) Write(p []byte) (int, error) {
+	f.written <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (f *fakeCI) send(t *testing.T, p mci.Packet) {
+	frame, err := mci.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.w.Write(append([]byte{byte(len(frame) + 1)}, frame...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxCompletesAfterCancel(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := i.sendTxCommand(ctx, mci.TX{Datapoint: 1, Event: MCI_TE_SWITCH, Data: []byte{MCI_TED_ON}})
+		result <- err
+	}()
+
+	frame := <-ci.written
+	packet, err := mci.Unmarshal(frame[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutting down while the command is on the wire
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	ci.send(t, mci.Status{Status: MGW_STT_OK,
+		Data: []byte{STATUS_OK_MRF, packet.(mci.TX).Seq << 4, STATUS_DATA_OKMRF_ACK_DIRECT}})
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("got %v, expected the command to be acknowledged", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no result")
+	}
+}
+
+// FuzzRun feeds random frames from the CI to the event loop
+func FuzzRun(f *testing.F) {
+	f.Add([]byte{0x0C, 0xC1, 0x01, 0x62, 0x17, 0x00, 0x00, 0xE6, 0x00, 0x14, 0x48, 0x10})
+	f.Add([]byte{0x0C, 0xC1, 0x02, 0x70, 0x00, 0x32, 0x00, 0x00, 0x00, 0x00, 0x48, 0x10})
+	f.Add([]byte{0x05, 0xC3, 0x1C, 0x04, 0x50, 0x10})
+	f.Add([]byte{0x05, 0xC3, 0x0A, 0x00, 0x05})
+	f.Add([]byte{0x0D, 0xC1, 0x00, 0x73, 0x39, 0x00, 0x87, 0xD6, 0x12, 0x00, 0x15, 0x01, 0x33})
+	f.Add([]byte{0x03, 0xD1, 0x22})
+	f.Add([]byte{0x00, 0xFF})
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		i := &Interface{}
+		i.Init(nopHandler{}, false)
+		if err := i.ReadFile("testdata/sample.dpl"); err != nil {
+			t.Fatal(err)
+		}
+
+		r, w := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- i.Run(context.Background(), pipeConn{r})
+		}()
+
+		// Run stops reading if it fails
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Run failed after [% x]: %v", data, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Run didn't return after [% x]", data)
+		}
+	})
+}
+
+// unknownPacket is a packet type mci.Marshal doesn't know
+type unknownPacket struct{}
+
+func (unknownPacket) Type() mci.PacketType { return 0 }
+
+func TestMarshalFailure(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	// The command fails, without stopping the event loop
+	if _, err := i.sendAwaitingResponse(ctx, i.extendedCommandChan, unknownPacket{}); !errors.Is(err, mci.ErrUnknownPacketType) {
+		t.Fatalf("got %v, expected ErrUnknownPacketType", err)
+	}
+	expectNothing(t, ci)
+
+	go i.RequestDPL(ctx)
+	expectExtended(t, ci)
+}
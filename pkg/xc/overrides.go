@@ -0,0 +1,106 @@
+package xc
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Override changes or adds a datapoint on top of the datapoint list read
+// from file or eprom.  Datapoints not in the list are added if Serial and
+// Type are set.
+type Override struct {
+	Name    string `json:"name,omitempty"`
+	Ignore  bool   `json:"ignore,omitempty"`
+	Serial  int    `json:"serial,omitempty"`
+	Type    int    `json:"type,omitempty"`
+	Channel int    `json:"channel,omitempty"`
+	Mode    int    `json:"mode,omitempty"`
+	Sensor  bool   `json:"sensor,omitempty"`
+}
+
+// ReadOverrides reads datapoint overrides from a JSON file, keyed by
+// datapoint number, e.g.:
+//
+//	{
+//	  "12": {"name": "Kitchen"},
+//	  "13": {"ignore": true},
+//	  "40": {"serial": 1234567, "type": 16, "name": "Garage"}
+//	}
+//
+// The overrides are applied to every datapoint list read from then on.
+func (i *Interface) ReadOverrides(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var overrides map[string]Override
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return errors.Wrapf(err, "parsing %s", filename)
+	}
+
+	i.overrides = make(map[byte]Override)
+	for k, v := range overrides {
+		number, err := strconv.Atoi(k)
+		if err != nil || number < 0 || number > 255 {
+			return errors.Errorf("%s: invalid datapoint '%s'", filename, k)
+		}
+		i.overrides[byte(number)] = v
+	}
+
+	return nil
+}
+
+func (i *Interface) applyOverrides(devices map[int]*Device, datapoints map[byte]*Datapoint) {
+	for number, o := range i.overrides {
+		dp, exists := datapoints[number]
+
+		switch {
+		case o.Ignore:
+			if exists {
+				dp.device.removeDatapoint(dp)
+				if len(dp.device.datapoints) == 0 {
+					delete(devices, dp.device.serialNumber)
+				}
+				delete(datapoints, number)
+			}
+
+		case exists:
+			if o.Name != "" {
+				dp.name = o.Name
+			}
+
+		case o.Serial != 0 && o.Type != 0:
+			device, exists := devices[o.Serial]
+			if !exists {
+				device = &Device{
+					serialNumber: o.Serial,
+					deviceType:   DeviceType(o.Type),
+					iface:        i,
+				}
+				devices[o.Serial] = device
+			}
+
+			dp := &Datapoint{
+				device:  device,
+				name:    o.Name,
+				number:  number,
+				channel: o.Channel,
+				mode:    o.Mode,
+				sensor:  o.Sensor,
+			}
+
+			device.datapoints = append(device.datapoints, dp)
+			device.setName(o.Name)
+			datapoints[number] = dp
+
+		default:
+			log.Printf("Override for datapoint %d ignored; not in datapoint list, "+
+				"and serial or type not set", number)
+		}
+	}
+}
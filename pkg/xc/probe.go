@@ -0,0 +1,54 @@
+package xc
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
+)
+
+// Number of frames ProbeSerial reads while waiting for the response
+const probeMaxFrames = 32
+
+// ProbeSerial asks the CI on conn for its serial number, without running
+// the event loop, e.g. to identify a CI before deciding how to use it.
+// Other messages received meanwhile are dropped.  conn must time out reads,
+// since this blocks until the response is received.
+func ProbeSerial(conn io.ReadWriter) (uint32, error) {
+	frame, err := mci.Marshal(mci.Config{Command: CONF_SERIAL, Data: []byte{CF_DATA_GET}})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := (prependLength{conn}).Write(frame); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	buf := make([]byte, 256)
+	for count := 0; count < probeMaxFrames; count++ {
+		n, err := conn.Read(buf)
+		if errors.Is(err, ErrStartStopByte) {
+			continue
+		} else if err != nil {
+			return 0, errors.WithStack(err)
+		}
+
+		if n == 0 || int(buf[0]) > n || buf[0] == 0 {
+			continue
+		}
+		packet, err := mci.Unmarshal(buf[1:buf[0]])
+		if err != nil {
+			continue
+		}
+
+		if status, ok := packet.(mci.Status); ok && status.Status == MGW_STT_SERIAL {
+			if err := checkLength(status.Data, 5); err != nil {
+				return 0, err
+			}
+			return binary.BigEndian.Uint32(status.Data[1:]), nil
+		}
+	}
+
+	return 0, errors.WithStack(ErrNoResponse)
+}
@@ -2,6 +2,7 @@ package xc
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/csv"
 	"fmt"
@@ -19,27 +20,63 @@ import (
 
 var splitNameRE = regexp.MustCompile(`^(.+) \((.+)\)$`)
 
+// ReadFile reads datapoints from a TXT or DPL file exported from the MRF
+// software.  The datapoints are merged on top of any read from the eprom.
+// Must be called before Run; use ReloadFile once running.
 func (i *Interface) ReadFile(filename string) error {
-	f, err := os.Open(filename)
+	_, datapoints, err := i.readFile(filename)
 	if err != nil {
 		return err
 	}
 
+	i.layerMutex.Lock()
+	defer i.layerMutex.Unlock()
+
+	devices, datapoints := i.setFileLayer(datapoints)
+	i.applyOverrides(devices, datapoints)
+	i.devices, i.datapoints = devices, datapoints
+
+	return nil
+}
+
+// ReloadFile rereads datapoints from file while the event loop is running,
+// and notifies the handler of the changes, if any.
+func (i *Interface) ReloadFile(ctx context.Context, filename string) error {
+	_, datapoints, err := i.readFile(filename)
+	if err != nil {
+		return err
+	}
+
+	i.layerMutex.Lock()
+	devices, datapoints := i.setFileLayer(datapoints)
+	diff := i.setup(ctx, devices, datapoints)
+	i.layerMutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !diff.IsEmpty() {
+		i.handler.DPLChanged(diff)
+	}
+
+	return nil
+}
+
+func (i *Interface) readFile(filename string) (map[int]*Device, map[byte]*Datapoint, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
 	extension := filepath.Ext(filename)
 	switch strings.ToLower(extension) {
 	case ".txt":
-		if i.devices, i.datapoints, err = i.txtReader(f); err != nil {
-			return err
-		}
+		return i.txtReader(f)
 	case ".dpl":
-		if i.devices, i.datapoints, err = i.dplReader(f); err != nil {
-			return err
-		}
+		return i.dplReader(f)
 	default:
-		return fmt.Errorf("unknown file type %s", extension)
+		return nil, nil, fmt.Errorf("unknown file type %s", extension)
 	}
-
-	return nil
 }
 
 func (i *Interface) txtReader(file io.Reader) (devices map[int]*Device, datapoints map[byte]*Datapoint, err error) {
@@ -80,6 +117,11 @@ func (i *Interface) txtReader(file io.Reader) (devices map[int]*Device, datapoin
 			return nil, nil, errors.WithStack(err)
 		}
 
+		if datapoint < 0 || datapoint > 255 {
+			line, _ := r.FieldPos(0)
+			return nil, nil, errors.Errorf("line %d: datapoint %d out of range", line, datapoint)
+		}
+
 		device, exists := devices[serialNo]
 		if !exists {
 			device = &Device{
@@ -113,125 +155,194 @@ func (i *Interface) txtReader(file io.Reader) (devices map[int]*Device, datapoin
 	return devices, datapoints, nil
 }
 
+/* DPL files start with a 16 byte header, followed by a 16 byte basic entry
+   per datapoint, an extended header and an extended entry per datapoint,
+   holding names, software versions and locations, and a text list with
+   location names.  Only the EXT2 format has been seen in DPLs exported by
+   the MRF software, so other formats are rejected. */
+
+const (
+	dplBasicHeaderSize       = 16
+	dplBasicEntrySize        = 16
+	dplExtendedHeaderMinSize = 120
+
+	// Extended entries hold the name, software version and location;
+	// datapoints with shorter entries are skipped
+	dplExtendedEntrySize = 64
+	dplExtendedEntryName = 53
+)
+
 func (i *Interface) dplReader(in io.ReadSeeker) (devices map[int]*Device, datapoints map[byte]*Datapoint, err error) {
 	dec := charmap.Windows1252.NewDecoder()
 
 	datapoints = make(map[byte]*Datapoint)
 	devices = make(map[int]*Device)
 
-	basicHeader := make([]byte, 16)
+	basicHeader := make([]byte, dplBasicHeaderSize)
 
 	if _, err := io.ReadFull(in, basicHeader); err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, nil, errors.Wrap(err, "reading DPL header")
 	}
+
+	if bytes.Count(basicHeader, []byte{0}) == len(basicHeader) {
+		return nil, nil, errors.Wrap(ErrUnknownDPLFormat, "blank DPL header")
+	}
+
 	if basicHeader[0] != DPL_TYPE_EXT2 {
-		return nil, nil, ErrUnknownDPLFormat
+		return nil, nil, errors.Wrapf(ErrUnknownDPLFormat, "DPL type %d", basicHeader[0])
 	}
 
 	numberBasicEntries := int(basicHeader[8]&0xf)<<8 + int(basicHeader[9])
 
-	basicEntries := make([]byte, 16*numberBasicEntries)
+	basicEntries := make([]byte, dplBasicEntrySize*numberBasicEntries)
 	if _, err := io.ReadFull(in, basicEntries); err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, nil, errors.Wrapf(err, "reading %d DPL entries", numberBasicEntries)
 	}
 
+	extendedOffset := int64(binary.LittleEndian.Uint32(basicHeader[12:16]))
 	extendedHeader := make([]byte, int(basicHeader[11]))
-	if _, err := in.Seek(int64(binary.LittleEndian.Uint32(basicHeader[12:16])), io.SeekStart); err != nil {
+
+	if _, err := in.Seek(extendedOffset, io.SeekStart); err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
 	if _, err := io.ReadFull(in, extendedHeader); err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, nil, errors.Wrapf(err, "reading DPL extended header at offset %d", extendedOffset)
+	}
+	if len(extendedHeader) < dplExtendedHeaderMinSize {
+		return nil, nil, errors.Wrapf(ErrCorruptDPL,
+			"extended header is %d bytes, expected at least %d",
+			len(extendedHeader), dplExtendedHeaderMinSize)
 	}
 
+	textListOffset := int64(binary.LittleEndian.Uint32(extendedHeader[116:120]))
 	textList := make([]byte, binary.LittleEndian.Uint16(extendedHeader[114:116]))
-	if _, err := in.Seek(int64(binary.LittleEndian.Uint32(extendedHeader[116:120])), io.SeekStart); err != nil {
+	if _, err := in.Seek(textListOffset, io.SeekStart); err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
 	if _, err := io.ReadFull(in, textList); err != nil {
-		return nil, nil, errors.WithStack(err)
+		return nil, nil, errors.Wrapf(err, "reading DPL text list at offset %d", textListOffset)
 	}
 
-	locationName := make(map[uint16]string)
-	for len(textList) > 0 {
-		id := binary.LittleEndian.Uint16(textList[:2])
-		length := int(textList[2])
-		name := textList[3:length]
-
-		locationName[id] = string(name)
-
-		textList = textList[length:]
+	locationName, err := parseTextList(textList)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if _, err := in.Seek(int64(binary.LittleEndian.Uint32(basicHeader[12:16])+uint32(basicHeader[11])), io.SeekStart); err != nil {
+	if _, err := in.Seek(extendedOffset+int64(len(extendedHeader)), io.SeekStart); err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
 
 	for j := 0; j < numberBasicEntries; j++ {
-		extendedEntry := make([]byte, basicEntries[11])
+		basicEntry := basicEntries[j*dplBasicEntrySize : (j+1)*dplBasicEntrySize]
+
+		extendedEntry := make([]byte, basicEntry[11])
 		if _, err := io.ReadFull(in, extendedEntry); err != nil {
+			return nil, nil, errors.Wrapf(err, "reading DPL extended entry %d", j)
+		}
+
+		number := binary.LittleEndian.Uint16(basicEntry[:2])
+		if number > 255 {
+			return nil, nil, errors.Wrapf(ErrCorruptDPL, "entry %d has datapoint number %d", j, number)
+		}
+		if len(extendedEntry) < dplExtendedEntrySize {
+			log.Printf("Skipping datapoint %d, its DPL extended entry is %d bytes, expected %d",
+				number, len(extendedEntry), dplExtendedEntrySize)
+			continue
+		}
+
+		serialNo := int(binary.LittleEndian.Uint32(basicEntry[2:6]))
+		deviceType := binary.LittleEndian.Uint16(basicEntry[6:8])
+
+		utf8name, err := dec.Bytes(bytes.Trim(extendedEntry[:dplExtendedEntryName], "\x00"))
+		if err != nil {
 			return nil, nil, errors.WithStack(err)
 		}
 
-		serialNo := int(binary.LittleEndian.Uint32(basicEntries[2:6]))
-		deviceType := binary.LittleEndian.Uint16(basicEntries[6:8])
+		deviceName := strings.Join(strings.Fields(strings.TrimSpace(string(utf8name))), " ")
+		entityName := ""
+		if match := splitNameRE.FindStringSubmatch(deviceName); len(match) > 1 {
+			deviceName = match[1]
+			entityName = match[2]
+		}
 
-		if basicEntries[11] >= 64 {
-			utf8name, err := dec.Bytes(bytes.Trim(extendedEntry[:53], "\x00"))
-			if err != nil {
-				return nil, nil, errors.WithStack(err)
+		device, exists := devices[serialNo]
+		if !exists {
+			device = &Device{
+				serialNumber: serialNo,
+				deviceType:   DeviceType(deviceType),
+				iface:        i,
 			}
+			devices[serialNo] = device
+		}
 
-			device, exists := devices[serialNo]
-			if !exists {
-				device = &Device{
-					serialNumber: serialNo,
-					deviceType:   DeviceType(deviceType),
-					iface:        i,
-				}
-				devices[serialNo] = device
-			}
+		dp := &Datapoint{
+			device:  device,
+			name:    entityName,
+			number:  byte(number),
+			channel: int(basicEntry[8]),
+			mode:    int(basicEntry[9]),
+			sensor:  basicEntry[10] != 0,
+		}
 
-			deviceName := strings.Join(strings.Fields(strings.TrimSpace(string(utf8name))), " ")
-			entityName := ""
-			if match := splitNameRE.FindStringSubmatch(deviceName); len(match) > 1 {
-				deviceName = match[1]
-				entityName = match[2]
+		if extendedEntry[55] != 0 {
+			dp.location = Location{
+				Building: locationName[binary.LittleEndian.Uint16(extendedEntry[56:58])],
+				Floor:    locationName[binary.LittleEndian.Uint16(extendedEntry[59:61])],
+				Room:     locationName[binary.LittleEndian.Uint16(extendedEntry[62:64])],
 			}
+		}
 
-			dp := &Datapoint{
-				device:  device,
-				name:    entityName,
-				number:  byte(binary.LittleEndian.Uint16(basicEntries[:2])),
-				channel: int(basicEntries[8]),
-				mode:    int(basicEntries[9]),
-				sensor:  basicEntries[10] != 0,
-			}
+		device.datapoints = append(device.datapoints, dp)
+		device.setName(deviceName)
+		device.setLocation(dp.location)
+		device.setSoftwareVersion(extendedEntry[53], extendedEntry[54])
+		datapoints[dp.number] = dp
 
-			device.datapoints = append(device.datapoints, dp)
-			device.setName(deviceName)
-			datapoints[byte(dp.number)] = dp
-
-			if i.verbose {
-				log.Printf("Datapoint %d: device %s, serial %d, channel %d, '%s'",
-					dp.number, dp.device.deviceType, dp.device.serialNumber,
-					dp.channel, dp.fullname())
-
-				//log.Printf("SW version [%d, %d]", extendedEntry[53], extendedEntry[54])
-				if extendedEntry[55] != 0 {
-					location := fmt.Sprintf("%s, %s, %s",
-						locationName[binary.LittleEndian.Uint16(extendedEntry[56:58])],
-						locationName[binary.LittleEndian.Uint16(extendedEntry[59:61])],
-						locationName[binary.LittleEndian.Uint16(extendedEntry[62:64])])
-
-					log.Printf("Level: %d.%d.%d, location %s",
-						extendedEntry[55], extendedEntry[58], extendedEntry[61],
-						location)
-				}
-			}
+		if i.verbose {
+			log.Printf("Datapoint %d: device %s, serial %d, channel %d, '%s'",
+				dp.number, dp.device.deviceType, dp.device.serialNumber,
+				dp.channel, dp.fullname())
 
-			basicEntries = basicEntries[16:]
+			if device.swVersion != "" {
+				log.Printf("SW version %s", device.swVersion)
+			}
+			if !dp.location.IsZero() {
+				log.Printf("Level: %d.%d.%d, location %s",
+					extendedEntry[55], extendedEntry[58], extendedEntry[61],
+					dp.location)
+			}
 		}
 	}
 
 	return devices, datapoints, nil
 }
+
+// parseTextList parses the location names in the DPL text list, each entry
+// consisting of a two byte id, the length of the entry and the name.
+func parseTextList(textList []byte) (map[uint16]string, error) {
+	dec := charmap.Windows1252.NewDecoder()
+	locationName := make(map[uint16]string)
+
+	for offset := 0; offset < len(textList); {
+		entry := textList[offset:]
+		if len(entry) < 3 {
+			return nil, errors.Wrapf(ErrCorruptDPL, "truncated text list entry at offset %d", offset)
+		}
+
+		length := int(entry[2])
+		if length < 3 || length > len(entry) {
+			return nil, errors.Wrapf(ErrCorruptDPL,
+				"text list entry at offset %d has invalid length %d", offset, length)
+		}
+
+		utf8name, err := dec.Bytes(entry[3:length])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		locationName[binary.LittleEndian.Uint16(entry[:2])] = string(utf8name)
+		offset += length
+	}
+
+	return locationName, nil
+}
@@ -0,0 +1,148 @@
+package xc
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func readSample(t testing.TB, filename string) []byte {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkDatapoints checks that the datapoints and devices read are
+// consistent with each other
+func checkDatapoints(t *testing.T, devices map[int]*Device, datapoints map[byte]*Datapoint) {
+	for number, dp := range datapoints {
+		if dp.number != number {
+			t.Fatalf("datapoint %d stored as %d", dp.number, number)
+		}
+		if devices[dp.device.serialNumber] != dp.device {
+			t.Fatalf("device %d of datapoint %d not in devices", dp.device.serialNumber, number)
+		}
+	}
+}
+
+func TestDPLReader(t *testing.T) {
+	i := &Interface{}
+	devices, datapoints, err := i.dplReader(bytes.NewReader(readSample(t, "testdata/sample.dpl")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDatapoints(t, devices, datapoints)
+
+	if len(devices) != 3 || len(datapoints) != 4 {
+		t.Fatalf("read %d devices and %d datapoints, expected 3 and 4", len(devices), len(datapoints))
+	}
+
+	dp := datapoints[4]
+	if dp == nil || dp.Name() != "Right" || dp.Channel() != 1 || !dp.sensor {
+		t.Fatalf("datapoint 4 read as %+v", dp)
+	}
+	if name := dp.device.Name(); name != "Pushbutton" {
+		t.Errorf("device named '%s', expected 'Pushbutton'", name)
+	}
+	if location := dp.Location(); location.Floor != "Ground floor" || location.Room != "Living room" {
+		t.Errorf("datapoint 4 located in %s", location)
+	}
+	if version := datapoints[1].device.SoftwareVersion(); version == "" {
+		t.Errorf("no software version for device 1234567")
+	}
+}
+
+func TestDPLLocationWindows1252(t *testing.T) {
+	// Rename the kitchen to "Kjøkken" in Windows-1252
+	data := bytes.Replace(readSample(t, "testdata/sample.dpl"),
+		[]byte("\x0aKitchen"), []byte("\x0aKj\xf8kken"), 1)
+
+	i := &Interface{}
+	_, datapoints, err := i.dplReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room := datapoints[1].Location().Room; room != "Kjøkken" {
+		t.Fatalf("datapoint 1 located in %q, expected \"Kjøkken\"", room)
+	}
+}
+
+func TestTXTReader(t *testing.T) {
+	i := &Interface{}
+	devices, datapoints, err := i.txtReader(bytes.NewReader(readSample(t, "testdata/sample.txt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDatapoints(t, devices, datapoints)
+
+	if len(devices) != 3 || len(datapoints) != 4 {
+		t.Fatalf("read %d devices and %d datapoints, expected 3 and 4", len(devices), len(datapoints))
+	}
+	if dp := datapoints[2]; dp == nil || dp.device.deviceType != DT_CDAx_01 {
+		t.Fatalf("datapoint 2 read as %+v", dp)
+	}
+}
+
+func TestBlankDPL(t *testing.T) {
+	i := &Interface{}
+	_, _, err := i.dplReader(bytes.NewReader(make([]byte, 256)))
+	if !errors.Is(err, ErrUnknownDPLFormat) {
+		t.Fatalf("got %v, expected ErrUnknownDPLFormat", err)
+	}
+}
+
+func TestShortDPLExtendedEntry(t *testing.T) {
+	// The extended entry of datapoint 4, the last, cut short
+	data := readSample(t, "testdata/sample.dpl")
+	data[dplBasicHeaderSize+3*dplBasicEntrySize+11] = 48
+
+	i := &Interface{}
+	devices, datapoints, err := i.dplReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDatapoints(t, devices, datapoints)
+
+	if _, exists := datapoints[4]; exists || len(datapoints) != 3 {
+		t.Fatalf("read %d datapoints, expected datapoint 4 to be skipped", len(datapoints))
+	}
+}
+
+func TestUnsupportedDPLType(t *testing.T) {
+	i := &Interface{}
+	for _, dplType := range []byte{0, 1, 3} {
+		data := readSample(t, "testdata/sample.dpl")
+		data[0] = dplType
+		if _, _, err := i.dplReader(bytes.NewReader(data)); !errors.Is(err, ErrUnknownDPLFormat) {
+			t.Errorf("type %d: got %v, expected ErrUnknownDPLFormat", dplType, err)
+		}
+	}
+}
+
+func FuzzDPLReader(f *testing.F) {
+	f.Add(readSample(f, "testdata/sample.dpl"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		i := &Interface{}
+		devices, datapoints, err := i.dplReader(bytes.NewReader(data))
+		if err == nil {
+			checkDatapoints(t, devices, datapoints)
+		}
+	})
+}
+
+func FuzzTXTReader(f *testing.F) {
+	f.Add(readSample(f, "testdata/sample.txt"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		i := &Interface{}
+		devices, datapoints, err := i.txtReader(bytes.NewReader(data))
+		if err == nil {
+			checkDatapoints(t, devices, datapoints)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package xc
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy controls how commands to the stick are timed out and retried
+type RetryPolicy struct {
+	// Number of times a failed TX command is retried
+	Retries int
+	// Delay before retrying a TX command, doubled for each retry
+	Backoff time.Duration
+	// Decides whether a TX command that failed with the error is retried;
+	// if nil, the errors in RetryableErrors are retried
+	Retryable func(error) bool
+	// Time to wait for a TX command to be acknowledged before it's
+	// considered lost
+	TxTimeout time.Duration
+
+	// Time to wait for the stick to respond to a CONFIG or EXTENDED
+	// command before resending it
+	ResponseTimeout time.Duration
+	// Number of times a CONFIG or EXTENDED command is resent, negative
+	// to resend until the context is cancelled
+	ResponseRetries int
+}
+
+// DefaultRetryPolicy returns the policy used unless SetRetryPolicy is called
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Retries:         2,
+		Retryable:       retryableError,
+		TxTimeout:       10 * time.Second,
+		ResponseTimeout: 5 * time.Second,
+		ResponseRetries: -1,
+	}
+}
+
+// SetRetryPolicy replaces the retry policy; must be called before Run
+func (i *Interface) SetRetryPolicy(policy RetryPolicy) {
+	if policy.Retryable == nil {
+		policy.Retryable = retryableError
+	}
+	i.retryPolicy = policy
+}
+
+// backoff waits before the given retry of a TX command
+func (p *RetryPolicy) backoff(ctx context.Context, retry int) error {
+	if p.Backoff <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(p.Backoff << retry):
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+// resend returns true if a CONFIG or EXTENDED command that timed out
+// should be resent
+func (p *RetryPolicy) resend(retry int) bool {
+	return p.ResponseRetries < 0 || retry < p.ResponseRetries
+}
@@ -0,0 +1,106 @@
+package xc
+
+import (
+	"context"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
+)
+
+// Baud rates supported by RS232 CIs, by CONF_RS232_BAUD setting
+var rs232BaudRates = map[byte]int{
+	CF_DATA_BD1200:  1200,
+	CF_DATA_BD2400:  2400,
+	CF_DATA_BD4800:  4800,
+	CF_DATA_BD9600:  9600,
+	CF_DATA_BD14400: 14400,
+	CF_DATA_BD19200: 19200,
+	CF_DATA_BD38400: 38400,
+	CF_DATA_BD56700: 57600,
+}
+
+// RS232Config is the serial port configuration of an RS232 CI
+type RS232Config struct {
+	Baud        int
+	FlowControl bool
+	CRC         bool
+}
+
+/* The RS232 settings are read by sending the CONFIG command with
+   CF_DATA_GET, and are returned in the status with the same type as the
+   command:
+
+   0 = setting, as given when changing it */
+
+func (i *Interface) rs232Setting(ctx context.Context, command byte) (byte, error) {
+	data, err := i.sendConfigCommand(ctx, mci.Config{Command: command, Data: []byte{CF_DATA_GET}})
+	if err != nil {
+		return 0, err
+	}
+	if err := checkLength(data, 1); err != nil {
+		return 0, err
+	}
+
+	return data[0], nil
+}
+
+// RS232Config reads the serial port configuration of the CI
+func (i *Interface) RS232Config(ctx context.Context) (config RS232Config, err error) {
+	baud, err := i.rs232Setting(ctx, CONF_RS232_BAUD)
+	if err != nil {
+		return
+	}
+	var found bool
+	if config.Baud, found = rs232BaudRates[baud]; !found {
+		err = errors.Wrapf(ErrMalformedMessage, "unknown baud rate setting %d", baud)
+		return
+	}
+
+	flow, err := i.rs232Setting(ctx, CONF_RS232_FLOW)
+	if err != nil {
+		return
+	}
+	config.FlowControl = flow == CF_DATA_SET
+
+	crc, err := i.rs232Setting(ctx, CONF_RS232_CRC)
+	if err != nil {
+		return
+	}
+	config.CRC = crc == CF_DATA_SET
+
+	return
+}
+
+// SetRS232Baud changes the baud rate of the CI serial port.  The CI
+// switches to the new rate once it has responded.
+func (i *Interface) SetRS232Baud(ctx context.Context, baud int) error {
+	for setting, rate := range rs232BaudRates {
+		if rate == baud {
+			_, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_RS232_BAUD, Data: []byte{setting}})
+			return err
+		}
+	}
+
+	return errors.Errorf("unsupported baud rate %d", baud)
+}
+
+// SetRS232FlowControl enables or disables hardware flow control on the CI
+// serial port
+func (i *Interface) SetRS232FlowControl(ctx context.Context, enable bool) error {
+	_, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_RS232_FLOW, Data: []byte{setOrClear(enable)}})
+	return err
+}
+
+// SetRS232CRC enables or disables checksums on the CI serial port
+func (i *Interface) SetRS232CRC(ctx context.Context, enable bool) error {
+	_, err := i.sendConfigCommand(ctx, mci.Config{Command: CONF_RS232_CRC, Data: []byte{setOrClear(enable)}})
+	return err
+}
+
+func setOrClear(set bool) byte {
+	if set {
+		return CF_DATA_SET
+	}
+	return CF_DATA_CLEAR
+}
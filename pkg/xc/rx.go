@@ -2,35 +2,44 @@ package xc
 
 import (
 	"context"
-	"encoding/binary"
 	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
-func (i *Interface) rx(ctx context.Context, data []byte) error {
-	if data[1] == RX_EVENT_STATUS_EXT {
-		return i.extendedStatus(data[2:])
-	}
+func (i *Interface) rx(ctx context.Context, packet mci.Packet) error {
+	switch p := packet.(type) {
+	case mci.ExtendedStatus:
+		return i.extendedStatus(p)
 
-	if dp, found := i.datapoints[data[0]]; found {
-		return dp.rx(ctx, i.handler, data[1:])
-	}
+	case mci.BasicMode:
+		return i.basicMode(p)
+
+	case mci.RX:
+		if dp, found := i.datapoints[p.Datapoint]; found {
+			return dp.rx(ctx, i.handler, p)
+		}
+
+		log.Printf("Received message from unknown datapoint %d", p.Datapoint)
+		return notHandled("unknown datapoint")
 
-	log.Printf("Received message from unknown datapoint %d", data[0])
-	return errMsgNotHandled
+	default:
+		return notHandled("unknown message")
+	}
 }
 
-func (i *Interface) extendedStatus(data []byte) error {
-	switch data[0] {
+func (i *Interface) extendedStatus(status mci.ExtendedStatus) error {
+	switch status.DataType {
 	case RX_DATA_TYPE_SERIAL_NUMBER:
-		serial := int(binary.LittleEndian.Uint32(data[2:6]))
+		serial := int(status.Serial)
 		if device, found := i.devices[serial]; found {
-			return device.extendedStatus(i.handler, data[6:])
+			return device.extendedStatus(i.handler, status)
 		} else {
 			log.Printf("Received extended status message from unknown device %d", serial)
-			return errMsgNotHandled
+			return notHandled("unknown device")
 		}
 	default:
 		log.Println("Unhandled extended status message")
-		return errMsgNotHandled
+		return notHandled("unhandled extended status")
 	}
 }
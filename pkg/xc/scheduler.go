@@ -0,0 +1,160 @@
+package xc
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority of a TX command.  Interactive commands are always sent before
+// background commands that are waiting for a free slot.
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota
+	PriorityBackground
+
+	numPriorities = 2
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context that sends TX commands with the given
+// priority.  Commands are sent with PriorityInteractive by default.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+func priorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p >= 0 && p < numPriorities {
+		return p
+	}
+	return PriorityInteractive
+}
+
+// txScheduler limits the number of TX commands in flight.  Waiting commands
+// are granted a slot by priority, and round robin between datapoints within
+// the same priority, so that a burst of commands to one datapoint doesn't
+// hold up the others.
+type txScheduler struct {
+	m     sync.Mutex
+	free  int
+	queue [numPriorities]fairQueue
+}
+
+// fairQueue holds the waiters for each datapoint, and the order in which the
+// datapoints are served.
+type fairQueue struct {
+	order   []byte
+	waiters map[byte][]chan struct{}
+}
+
+func newTxScheduler(slots int) *txScheduler {
+	s := &txScheduler{free: slots}
+	for p := range s.queue {
+		s.queue[p].waiters = make(map[byte][]chan struct{})
+	}
+	return s
+}
+
+// Acquire waits for a free slot to send a command to the datapoint
+func (s *txScheduler) Acquire(ctx context.Context, priority Priority, dp byte) error {
+	s.m.Lock()
+	if s.free > 0 && s.idle() {
+		s.free--
+		s.m.Unlock()
+		return nil
+	}
+
+	ch := make(chan struct{}, 1)
+	s.queue[priority].push(dp, ch)
+	s.m.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		s.m.Lock()
+		removed := s.queue[priority].remove(dp, ch)
+		s.m.Unlock()
+
+		if !removed {
+			// Slot was granted while we were cancelled, pass it on
+			s.Release()
+		}
+		return ctx.Err()
+	}
+}
+
+// Release returns a slot, granting it to the next waiter if any
+func (s *txScheduler) Release() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for p := range s.queue {
+		if ch := s.queue[p].pop(); ch != nil {
+			ch <- struct{}{}
+			return
+		}
+	}
+	s.free++
+}
+
+func (s *txScheduler) idle() bool {
+	for p := range s.queue {
+		if len(s.queue[p].order) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *fairQueue) push(dp byte, ch chan struct{}) {
+	if len(q.waiters[dp]) == 0 {
+		q.order = append(q.order, dp)
+	}
+	q.waiters[dp] = append(q.waiters[dp], ch)
+}
+
+// pop returns the first waiter of the datapoint whose turn it is, and moves
+// the datapoint to the back of the line if it has more waiters.
+func (q *fairQueue) pop() chan struct{} {
+	if len(q.order) == 0 {
+		return nil
+	}
+
+	dp := q.order[0]
+	q.order = q.order[1:]
+
+	waiters := q.waiters[dp]
+	ch := waiters[0]
+	if len(waiters) > 1 {
+		q.waiters[dp] = waiters[1:]
+		q.order = append(q.order, dp)
+	} else {
+		delete(q.waiters, dp)
+	}
+
+	return ch
+}
+
+func (q *fairQueue) remove(dp byte, ch chan struct{}) bool {
+	waiters := q.waiters[dp]
+	for i := range waiters {
+		if waiters[i] == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			if len(waiters) > 0 {
+				q.waiters[dp] = waiters
+			} else {
+				delete(q.waiters, dp)
+				for j := range q.order {
+					if q.order[j] == dp {
+						q.order = append(q.order[:j], q.order[j+1:]...)
+						break
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package xc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// queued returns the number of commands waiting for a slot
+func (s *txScheduler) queued() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	n := 0
+	for p := range s.queue {
+		for _, waiters := range s.queue[p].waiters {
+			n += len(waiters)
+		}
+	}
+	return n
+}
+
+// enqueue starts a command waiting for a slot, and waits until it's queued,
+// so that the order of the waiters is known.  The datapoint is sent to
+// granted when the command gets a slot.
+func enqueue(t *testing.T, s *txScheduler, ctx context.Context, priority Priority,
+	dp byte, granted chan<- byte) <-chan error {
+
+	t.Helper()
+
+	n := s.queued()
+	result := make(chan error, 1)
+	go func() {
+		err := s.Acquire(ctx, priority, dp)
+		if err == nil {
+			granted <- dp
+		}
+		result <- err
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for s.queued() == n {
+		if time.Now().After(deadline) {
+			t.Fatal("command not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return result
+}
+
+// grantOrder releases the slot held, and then each slot granted, returning
+// the datapoints in the order they were granted
+func grantOrder(t *testing.T, s *txScheduler, granted <-chan byte, n int) []byte {
+	t.Helper()
+
+	var order []byte
+	for j := 0; j < n; j++ {
+		s.Release()
+		select {
+		case dp := <-granted:
+			order = append(order, dp)
+		case <-time.After(time.Second):
+			t.Fatalf("slot not granted, granted %v so far", order)
+		}
+	}
+	return order
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := newTxScheduler(1)
+	ctx := context.Background()
+	if err := s.Acquire(ctx, PriorityInteractive, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan byte, 4)
+	enqueue(t, s, ctx, PriorityBackground, 1, granted)
+	enqueue(t, s, ctx, PriorityBackground, 2, granted)
+	enqueue(t, s, ctx, PriorityInteractive, 3, granted)
+	enqueue(t, s, ctx, PriorityInteractive, 4, granted)
+
+	order := grantOrder(t, s, granted, 4)
+	if expected := []byte{3, 4, 1, 2}; string(order) != string(expected) {
+		t.Fatalf("granted %v, expected %v", order, expected)
+	}
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	s := newTxScheduler(1)
+	ctx := context.Background()
+	if err := s.Acquire(ctx, PriorityInteractive, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan byte, 5)
+	for _, dp := range []byte{1, 1, 1, 2, 3} {
+		enqueue(t, s, ctx, PriorityInteractive, dp, granted)
+	}
+
+	order := grantOrder(t, s, granted, 5)
+	if expected := []byte{1, 2, 3, 1, 1}; string(order) != string(expected) {
+		t.Fatalf("granted %v, expected %v", order, expected)
+	}
+}
+
+func TestSchedulerFreeSlot(t *testing.T) {
+	s := newTxScheduler(2)
+	ctx := context.Background()
+
+	for dp := byte(0); dp < 2; dp++ {
+		if err := s.Acquire(ctx, PriorityInteractive, dp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Release()
+	s.Release()
+
+	if s.free != 2 {
+		t.Fatalf("%d free slots, expected 2", s.free)
+	}
+}
+
+func TestSchedulerCancelled(t *testing.T) {
+	s := newTxScheduler(1)
+	if err := s.Acquire(context.Background(), PriorityInteractive, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	granted := make(chan byte, 2)
+	result := enqueue(t, s, ctx, PriorityInteractive, 1, granted)
+
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	}
+	if n := s.queued(); n != 0 {
+		t.Fatalf("%d commands queued after cancelling", n)
+	}
+
+	s.Release()
+	if s.free != 1 {
+		t.Fatalf("%d free slots, expected 1", s.free)
+	}
+}
+
+// A command cancelled after being granted a slot passes it on, rather
+// than losing it
+func TestSchedulerCancelledAfterGrant(t *testing.T) {
+	// The command may see either the grant or the cancellation first
+	for run := 0; run < 100; run++ {
+		s := newTxScheduler(1)
+		if err := s.Acquire(context.Background(), PriorityInteractive, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		granted := make(chan byte, 2)
+		cancelled := enqueue(t, s, ctx, PriorityInteractive, 1, granted)
+		next := enqueue(t, s, context.Background(), PriorityInteractive, 2, granted)
+
+		// Cancel and grant the slot at once, as Release would
+		s.m.Lock()
+		cancel()
+		s.queue[PriorityInteractive].pop() <- struct{}{}
+		s.m.Unlock()
+
+		if err := <-cancelled; err == nil {
+			// Got the slot before noticing the cancellation
+			if dp := <-granted; dp != 1 {
+				t.Fatalf("granted %d, expected 1", dp)
+			}
+			s.Release()
+		}
+
+		if err := <-next; err != nil {
+			t.Fatal(err)
+		}
+		if dp := <-granted; dp != 2 {
+			t.Fatalf("granted %d, expected 2", dp)
+		}
+
+		s.Release()
+		if s.free != 1 {
+			t.Fatalf("%d free slots, expected 1", s.free)
+		}
+	}
+}
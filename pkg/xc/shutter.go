@@ -3,6 +3,8 @@ package xc
 import (
 	"context"
 	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
 type ShutterCommand byte
@@ -27,11 +29,11 @@ const (
 	ShutterStateUnknown ShutterStatus = "unknown"
 )
 
-func (d *Datapoint) Shutter(ctx context.Context, cmd ShutterCommand) ([]byte, error) {
+func (d *Datapoint) Shutter(ctx context.Context, cmd ShutterCommand) (TxResult, error) {
 	d.queue.Lock()
 	defer d.queue.Unlock()
 
-	return d.device.iface.sendTxCommand(ctx, []byte{d.number, MCI_TE_JALO, byte(cmd)})
+	return d.device.iface.sendTxCommand(ctx, mci.TX{Datapoint: d.number, Event: MCI_TE_JALO, Data: []byte{byte(cmd)}})
 }
 
 func (d *Datapoint) shutterStatus(h Handler, status byte) (string, error) {
@@ -47,7 +49,7 @@ func (d *Datapoint) shutterStatus(h Handler, status byte) (string, error) {
 		return "status shutter closing", nil
 	default:
 		log.Printf("unknown shutter status %d\n", status)
-		return "unknown", errMsgNotHandled
+		return "unknown", notHandled("unknown status")
 	}
 }
 
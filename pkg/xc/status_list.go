@@ -0,0 +1,163 @@
+package xc
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
+)
+
+/* The status list (STL) holds the last message the CI received from each
+   datapoint.  It starts with a four byte header; the number of entries
+   (little endian) and the size of each entry.  Each entry has the same
+   layout as the payload of an RX message; see mci.RX.  This layout hasn't
+   been checked against a capture from a CI, so lists that don't fit it
+   are rejected rather than applied. */
+
+const (
+	stlMinEntrySize = 10
+
+	// One entry per datapoint at most
+	stlMaxEntries = 256
+
+	// Time to wait after the status list changes before rereading it, so
+	// that the changes made by ordinary traffic are read at once; the
+	// datapoints are updated by the messages themselves in the meantime
+	stlRefreshDelay = 30 * time.Second
+
+	// Time allowed for reading the status list, which only seeds the
+	// state of the datapoints, so isn't worth retrying for ever
+	stlTimeout = time.Minute
+)
+
+type statusList struct {
+	entries map[byte]mci.Packet
+	done    chan bool
+}
+
+func (i *Interface) stlReader(in io.Reader) (map[byte]mci.Packet, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	numberEntries := int(binary.LittleEndian.Uint16(header[:2]))
+	entrySize := int(header[2])
+	if entrySize < stlMinEntrySize {
+		return nil, errors.Wrapf(ErrUnknownSTLFormat, "entry size %d", entrySize)
+	}
+	if numberEntries > stlMaxEntries {
+		return nil, errors.Wrapf(ErrUnknownSTLFormat, "%d entries", numberEntries)
+	}
+
+	entries := make(map[byte]mci.Packet)
+	for j := 0; j < numberEntries; j++ {
+		entry := make([]byte, entrySize)
+		if _, err := io.ReadFull(in, entry); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		packet, err := mci.UnmarshalRX(entry[:stlMinEntrySize])
+		if err != nil {
+			log.Printf("Ignoring status list entry %d: %v", j, err)
+			continue
+		}
+		entries[entry[0]] = packet
+	}
+
+	return entries, nil
+}
+
+// RequestSTL reads the status list from the CI and updates the state of all
+// known datapoints from it.
+func (i *Interface) RequestSTL(ctx context.Context) error {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, stlTimeout)
+	defer cancel()
+
+	if i.verbose {
+		log.Println("Reading status list from eprom")
+	}
+
+	i.extendedMutex.Lock()
+	defer i.extendedMutex.Unlock()
+
+	entries, err := i.stlReader(&stickReader{ctx, i, MCI_ET_REQU_STL, MCI_ET_SEND_STL, 0})
+	if err != nil {
+		if errors.Is(err, ErrUnknown) {
+			log.Printf("Warning: CI doesn't support extended commands, " +
+				"cannot read status list from eprom.")
+			return nil
+		}
+		return err
+	}
+
+	done := make(chan bool, 1)
+	select {
+	case i.statusChan <- statusList{entries, done}:
+	case <-i.stopping:
+		return nil
+	}
+
+	log.Printf("Read status list with %d entries from eprom in %s",
+		len(entries), time.Since(start))
+
+	select {
+	case <-ctx.Done():
+	case <-i.stopping:
+	case <-done:
+	}
+
+	return nil
+}
+
+// scheduleSTLRefresh rereads the status list from the eprom in the
+// background, once stlDelay has passed.  Changes made before the reread
+// starts are coalesced into it.
+func (i *Interface) scheduleSTLRefresh(ctx context.Context) {
+	i.stlMutex.Lock()
+	defer i.stlMutex.Unlock()
+
+	if i.stlRefresh != nil {
+		return
+	}
+
+	i.stlRefresh = time.AfterFunc(i.stlDelay, func() {
+		i.stlMutex.Lock()
+		i.stlRefresh = nil
+		i.stlMutex.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+		if err := i.RequestSTL(ctx); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// applyStatusList seeds the state of switching, dimming and shutter
+// actuators from the status list.  Entries are the last message received,
+// not new ones, so events aren't passed on to the handler again, and the
+// signal strength and battery state of the devices are left as they are.
+func (i *Interface) applyStatusList(entries map[byte]mci.Packet) {
+	for number, entry := range entries {
+		dp, found := i.datapoints[number]
+		if !found {
+			continue
+		}
+		rx, ok := entry.(mci.RX)
+		if !ok || rx.Event != RX_EVENT_STATUS {
+			continue
+		}
+		if _, err := dp.status(i.handler, rx.InfoShort); err != nil {
+			log.Printf("Ignoring status list entry for datapoint %d: %v", number, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package xc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
+)
+
+func TestApplyStatusList(t *testing.T) {
+	h := &recordingHandler{}
+	i := &Interface{}
+	i.Init(h, false)
+	if err := i.ReadFile("testdata/sample.dpl"); err != nil {
+		t.Fatal(err)
+	}
+
+	hrv := &Device{deviceType: DT_CHVZ_01, serialNumber: 4567890, iface: i}
+	i.devices[hrv.serialNumber] = hrv
+	i.datapoints[5] = &Datapoint{device: hrv, number: 5}
+	hrv.datapoints = append(hrv.datapoints, i.datapoints[5])
+
+	light := i.Datapoint(1).Device()
+	light.rssi, light.battery = 50, 16
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	entries := map[byte]mci.Packet{
+		1: mci.RX{Datapoint: 1, Event: RX_EVENT_STATUS, InfoShort: RX_IS_ON, RSSI: 100, Battery: 4},
+		3: mci.RX{Datapoint: 3, Event: RX_EVENT_SWITCH_ON, DataType: RX_DATA_TYPE_NO_DATA, RSSI: 100},
+		// Valve requesting the temperature setpoint
+		5: mci.RX{Datapoint: 5, Event: RX_EVENT_VALUE, DataType: RX_DATA_TYPE_HRV_OUT,
+			Value: [4]byte{0, 50, MGW_HRV_REQ_TSETPOINT << 4, 200}, RSSI: 100},
+	}
+	done := make(chan bool, 1)
+	i.statusChan <- statusList{entries, done}
+	<-done
+
+	expectNothing(t, ci)
+
+	expected := []string{"1 on true"}
+	if !reflect.DeepEqual(h.calls, expected) {
+		t.Errorf("got %q, expected %q", h.calls, expected)
+	}
+	if light.rssi != 50 || light.battery != 16 {
+		t.Errorf("signal %d and battery %d overwritten", light.rssi, light.battery)
+	}
+}
+
+func TestSTLReader(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	on := []byte{1, RX_EVENT_STATUS, 0, RX_IS_ON, 0, 0, 0, 0, 60, 16}
+	off := []byte{2, RX_EVENT_STATUS, 0, RX_IS_OFF, 0, 0, 0, 0, 60, 16}
+
+	// Entries may be larger than an RX message
+	stl := []byte{2, 0, 12, 0}
+	stl = append(stl, append(on, 0xAA, 0xBB)...)
+	stl = append(stl, append(off, 0xAA, 0xBB)...)
+
+	entries, err := i.stlReader(bytes.NewReader(stl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[byte]mci.Packet{
+		1: mci.RX{Datapoint: 1, Event: RX_EVENT_STATUS, InfoShort: RX_IS_ON, RSSI: 60, Battery: 16},
+		2: mci.RX{Datapoint: 2, Event: RX_EVENT_STATUS, InfoShort: RX_IS_OFF, RSSI: 60, Battery: 16},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("got %+v, expected %+v", entries, expected)
+	}
+
+	// The count is little endian
+	many := []byte{0, 1, 10, 0}
+	for j := 0; j < 256; j++ {
+		many = append(many, byte(j), RX_EVENT_STATUS, 0, RX_IS_ON, 0, 0, 0, 0, 60, 16)
+	}
+	if entries, err := i.stlReader(bytes.NewReader(many)); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 256 {
+		t.Errorf("got %d entries, expected 256", len(entries))
+	}
+
+	if _, err := i.stlReader(bytes.NewReader(append([]byte{1, 0, 9, 0}, on[:9]...))); !errors.Is(err, ErrUnknownSTLFormat) {
+		t.Errorf("entry size 9: got %v, expected ErrUnknownSTLFormat", err)
+	}
+	if _, err := i.stlReader(bytes.NewReader(append([]byte{2, 0, 10, 0}, on...))); !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		t.Errorf("truncated body: got %v, expected EOF", err)
+	}
+	if _, err := i.stlReader(bytes.NewReader([]byte{1, 1, 10, 0})); !errors.Is(err, ErrUnknownSTLFormat) {
+		t.Errorf("257 entries: got %v, expected ErrUnknownSTLFormat", err)
+	}
+	if _, err := i.stlReader(bytes.NewReader([]byte{1, 0})); err == nil {
+		t.Error("truncated header accepted")
+	}
+}
+
+func TestSTLRefresh(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+	i.stlDelay = 100 * time.Millisecond
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	// Changes before the reread starts give one read, after the delay
+	for j := 0; j < 5; j++ {
+		ci.send(t, mci.Extended{Command: MCI_ET_STL_CHANGED})
+	}
+	expectNothing(t, ci)
+	expectExtended(t, ci)
+	expectNothing(t, ci)
+}
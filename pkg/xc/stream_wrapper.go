@@ -18,7 +18,7 @@ func (s StartStopWrapper) Read(p []byte) (n int, err error) {
 	}
 
 	if p[0] != MCI_SER_START {
-		return 0, errStartStopByte
+		return 0, ErrStartStopByte
 	}
 
 	if _, err = s.w.Read(p[:1]); err != nil {
@@ -34,7 +34,7 @@ func (s StartStopWrapper) Read(p []byte) (n int, err error) {
 	}
 
 	if p[packetLength] != MCI_SER_STOP {
-		return 0, errStartStopByte
+		return 0, ErrStartStopByte
 	}
 
 	return
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/binary"
 	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
 )
 
 /* New switching actuator output channels:
@@ -72,19 +74,19 @@ func extendedOutputStatusName(status byte) string {
 	}
 }
 
-func (d *Datapoint) Switch(ctx context.Context, on bool) ([]byte, error) {
+func (d *Datapoint) Switch(ctx context.Context, on bool) (TxResult, error) {
 	last := d.queue.Lock()
 	defer d.queue.Unlock()
 
 	if !last {
 		// There are newer commands, discard
-		return nil, nil
+		return TxResult{Discarded: true}, nil
 	}
 
 	if on {
-		return d.device.iface.sendTxCommand(ctx, []byte{d.number, MCI_TE_SWITCH, MCI_TED_ON})
+		return d.device.iface.sendTxCommand(ctx, mci.TX{Datapoint: d.number, Event: MCI_TE_SWITCH, Data: []byte{MCI_TED_ON}})
 	} else {
-		return d.device.iface.sendTxCommand(ctx, []byte{d.number, MCI_TE_SWITCH, MCI_TED_OFF})
+		return d.device.iface.sendTxCommand(ctx, mci.TX{Datapoint: d.number, Event: MCI_TE_SWITCH, Data: []byte{MCI_TED_OFF}})
 	}
 }
 
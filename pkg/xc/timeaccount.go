@@ -0,0 +1,140 @@
+package xc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Time after the budget was reported used up that commands are sent
+// again, unless the stick has reported that it has recovered
+const timeaccountZeroHold = 30 * time.Second
+
+// Timeaccount is the transmission budget of the stick, as limited by the
+// duty cycle regulations.  When the budget drops below 10%, background
+// commands are held back until it climbs above 15% again; when it's used
+// up, commands fail with ErrTimeaccountZero until a command is
+// acknowledged, the stick reports a budget above zero, or
+// timeaccountZeroHold has passed.
+type Timeaccount struct {
+	// Last reported budget in percent, -1 if not known
+	Percent int  `json:"percent"`
+	Low     bool `json:"low"`
+	Zero    bool `json:"zero"`
+}
+
+type timeaccount struct {
+	sync.Mutex
+	state   Timeaccount
+	zeroAt  time.Time
+	changed chan struct{}
+}
+
+func newTimeaccount() *timeaccount {
+	return &timeaccount{
+		state:   Timeaccount{Percent: -1},
+		changed: make(chan struct{}),
+	}
+}
+
+// get returns the current state, and a channel that is closed when the
+// state changes
+func (t *timeaccount) get() (Timeaccount, <-chan struct{}) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.state.Zero && time.Since(t.zeroAt) > timeaccountZeroHold {
+		// Try again; the budget may have recovered without the stick
+		// telling
+		t.state.Zero = false
+		t.notify()
+	}
+
+	return t.state, t.changed
+}
+
+// update applies a timeaccount status message from the stick
+func (t *timeaccount) update(status, percent byte) {
+	t.Lock()
+	defer t.Unlock()
+
+	switch status {
+	case STATUS_DATA:
+		t.state.Percent = int(percent)
+		t.state.Zero = percent == 0
+		t.state.Low = percent < 10 || (t.state.Low && percent <= 15)
+	case STATUS_IS_0:
+		t.state = Timeaccount{Percent: 0, Low: true, Zero: true}
+	case STATUS_LESS_10:
+		if t.state.Percent >= 10 {
+			t.state.Percent = -1
+		}
+		t.state.Low = true
+	case STATUS_MORE_15:
+		if t.state.Percent <= 15 {
+			t.state.Percent = -1
+		}
+		t.state.Low = false
+		t.state.Zero = false
+	default:
+		return
+	}
+
+	if t.state.Zero {
+		t.zeroAt = time.Now()
+	}
+	t.notify()
+}
+
+// acknowledged records that a command was acknowledged, showing that the
+// budget isn't used up
+func (t *timeaccount) acknowledged() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.state.Zero {
+		t.state.Zero = false
+		t.notify()
+	}
+}
+
+func (t *timeaccount) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Timeaccount returns the last known transmission budget of the stick
+func (i *Interface) Timeaccount() Timeaccount {
+	state, _ := i.timeaccount.get()
+	return state
+}
+
+// waitTimeaccount fails if the transmission budget is used up, and holds
+// back background commands while the budget is low
+func (i *Interface) waitTimeaccount(ctx context.Context, priority Priority, dp byte) error {
+	for logged := false; ; logged = true {
+		state, changed := i.timeaccount.get()
+
+		if state.Zero {
+			return errors.WithStack(ErrTimeaccountZero)
+		}
+		if !state.Low || priority == PriorityInteractive {
+			return nil
+		}
+
+		if !logged {
+			log.Printf("Timeaccount low, deferring background command for datapoint %d", dp)
+		}
+
+		select {
+		case <-changed:
+		case <-i.stopping:
+			return errors.WithStack(ErrShuttingDown)
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package xc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+)
+
+func TestTimeaccountZero(t *testing.T) {
+	ta := newTimeaccount()
+
+	ta.update(STATUS_IS_0, 0)
+	if state, _ := ta.get(); !state.Zero {
+		t.Fatal("not zero after STATUS_IS_0")
+	}
+
+	ta.acknowledged()
+	if state, _ := ta.get(); state.Zero {
+		t.Fatal("still zero after a command was acknowledged")
+	}
+
+	ta.update(STATUS_IS_0, 0)
+	ta.zeroAt = time.Now().Add(-timeaccountZeroHold - time.Second)
+	if state, _ := ta.get(); state.Zero || !state.Low {
+		t.Fatalf("got %+v after the hold, expected low but not zero", state)
+	}
+}
+
+func TestShortTimeaccountStatus(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	ci.send(t, mci.Status{Status: MCI_STT_TIMEACCOUNT, Data: []byte{STATUS_DATA}})
+	ci.send(t, mci.Status{Status: MCI_STT_TIMEACCOUNT})
+
+	deadline := time.Now().Add(time.Second)
+	for i.RejectedFrames() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames rejected, expected 2", i.RejectedFrames())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if state, _ := i.timeaccount.get(); state.Zero || state.Low {
+		t.Fatalf("got %+v from short statuses", state)
+	}
+}
+
+func TestUnsolicitedTimeaccount(t *testing.T) {
+	i := &Interface{}
+	i.Init(nopHandler{}, false)
+
+	ci := newFakeCI()
+	defer ci.w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go i.Run(ctx, ci)
+
+	type result struct {
+		serial uint32
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		serial, err := i.Serial(ctx)
+		done <- result{serial, err}
+	}()
+
+	select {
+	case frame := <-ci.written:
+		if frame[1] != MCI_PT_CONFIG {
+			t.Fatalf("sent [% x], expected CONFIG", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no CONFIG request")
+	}
+
+	// Reported by the stick while waiting for the serial number
+	ci.send(t, mci.Status{Status: MCI_STT_TIMEACCOUNT, Data: []byte{STATUS_DATA, 50}})
+	ci.send(t, mci.Status{Status: MGW_STT_SERIAL, Data: []byte{CF_DATA_GET, 0, 0x12, 0xD6, 0x87}})
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.serial != 1234567 {
+			t.Fatalf("got %d, %v, expected 1234567", res.serial, res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no serial number")
+	}
+}
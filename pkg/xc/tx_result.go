@@ -0,0 +1,76 @@
+package xc
+
+import "time"
+
+// AckKind tells how the stick learned that a TX command was delivered
+type AckKind int
+
+const (
+	// No information, e.g. the actuator doesn't send acknowledgements
+	AckNone AckKind = iota
+	// Acknowledged directly by the actuator
+	AckDirect
+	// Acknowledged by the actuator via a router
+	AckRouted
+	// Acknowledged, route not reported
+	AckAcknowledged
+	// Acknowledged by an actuator assigned in Basic Mode
+	AckBasicMode
+)
+
+func (a AckKind) String() string {
+	switch a {
+	case AckDirect:
+		return "direct"
+	case AckRouted:
+		return "routed"
+	case AckAcknowledged:
+		return "ack"
+	case AckBasicMode:
+		return "basic_mode"
+	default:
+		return "none"
+	}
+}
+
+func (a AckKind) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// TxResult is the outcome of a TX command
+type TxResult struct {
+	Ack AckKind
+	// The stick reported that the datapoint has been removed
+	DatapointRemoved bool
+	// Number of times the command was resent
+	Retries int
+	// Time from the command was first sent until it was acknowledged
+	Latency time.Duration
+	// The command was superseded by a newer command to the same
+	// datapoint, and not sent
+	Discarded bool
+}
+
+// Confirmed returns true if the command is known to have reached the
+// actuator, so that its state can be assumed to have changed
+func (r TxResult) Confirmed() bool {
+	return !r.Discarded && r.Ack != AckNone
+}
+
+// parseOKMRF parses the status data of a STATUS_OK_MRF message
+func parseOKMRF(status byte) (ack AckKind, removed bool) {
+	switch status &^ STATUS_DATA_OKMRF_DPREMOVED {
+	case STATUS_DATA_OKMRF_ACK_DIRECT:
+		ack = AckDirect
+	case STATUS_DATA_OKMRF_ACK_ROUTED:
+		ack = AckRouted
+	case STATUS_DATA_OKMRF_ACK:
+		ack = AckAcknowledged
+	case STATUS_DATA_OKMRF_ACK_BM:
+		ack = AckBasicMode
+	default:
+		ack = AckNone
+	}
+
+	return ack, status&STATUS_DATA_OKMRF_DPREMOVED != 0
+}
@@ -0,0 +1,116 @@
+package xc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseOKMRF(t *testing.T) {
+	tests := []struct {
+		status byte
+		ack    AckKind
+		name   string
+	}{
+		{STATUS_DATA_OKMRF_NOINFO, AckNone, "none"},
+		{STATUS_DATA_OKMRF_ACK_DIRECT, AckDirect, "direct"},
+		{STATUS_DATA_OKMRF_ACK_ROUTED, AckRouted, "routed"},
+		{STATUS_DATA_OKMRF_ACK, AckAcknowledged, "ack"},
+		{STATUS_DATA_OKMRF_ACK_BM, AckBasicMode, "basic_mode"},
+		// Unknown codes carry no information
+		{0x50, AckNone, "none"},
+	}
+
+	for _, test := range tests {
+		for _, removed := range []bool{false, true} {
+			status := test.status
+			if removed {
+				status |= STATUS_DATA_OKMRF_DPREMOVED
+			}
+
+			ack, dpRemoved := parseOKMRF(status)
+			if ack != test.ack || dpRemoved != removed {
+				t.Errorf("%#02x: got %v, removed %v, expected %v, removed %v",
+					status, ack, dpRemoved, test.ack, removed)
+			}
+			if ack.String() != test.name {
+				t.Errorf("%#02x: named '%s', expected '%s'", status, ack, test.name)
+			}
+		}
+	}
+}
+
+func TestTxResult(t *testing.T) {
+	tests := []struct {
+		// Error codes the stick fails the command with before it's
+		// acknowledged
+		failures []byte
+		okStatus byte
+		result   TxResult
+		err      error
+	}{
+		{nil, STATUS_DATA_OKMRF_ACK_DIRECT, TxResult{Ack: AckDirect}, nil},
+		{nil, STATUS_DATA_OKMRF_NOINFO, TxResult{Ack: AckNone}, nil},
+		{[]byte{MCI_STS_NO_ACK}, STATUS_DATA_OKMRF_ACK_ROUTED, TxResult{Ack: AckRouted, Retries: 1}, nil},
+		{[]byte{MCI_STS_BUSY_MRF, MCI_STS_TX_MSG_LOST}, STATUS_DATA_OKMRF_ACK, TxResult{Ack: AckAcknowledged, Retries: 2}, nil},
+		{nil, STATUS_DATA_OKMRF_ACK_BM | STATUS_DATA_OKMRF_DPREMOVED,
+			TxResult{Ack: AckBasicMode, DatapointRemoved: true}, ErrDatapointRemoved},
+	}
+
+	for _, test := range tests {
+		i := &Interface{}
+		i.Init(nopHandler{}, false)
+		policy := DefaultRetryPolicy()
+		policy.Backoff = 0
+		i.SetRetryPolicy(policy)
+
+		ci := newFakeCI()
+		ctx, cancel := context.WithCancel(context.Background())
+		go i.Run(ctx, ci)
+
+		done := make(chan struct{})
+		var (
+			result TxResult
+			err    error
+		)
+		go func() {
+			defer close(done)
+			result, err = i.sendTxCommand(ctx, mci.TX{Datapoint: 1, Event: MCI_TE_SWITCH, Data: []byte{MCI_TED_ON}})
+		}()
+
+		for _, code := range test.failures {
+			seq := sentSeq(t, ci)
+			ci.send(t, mci.Status{Status: MCI_STT_ERROR, Data: []byte{code, seq << 4}})
+		}
+		seq := sentSeq(t, ci)
+		ci.send(t, mci.Status{Status: MGW_STT_OK, Data: []byte{STATUS_OK_MRF, seq << 4, test.okStatus}})
+		<-done
+
+		result.Latency = 0
+		if result != test.result || !errors.Is(err, test.err) {
+			t.Errorf("%+v: got %+v, %v, expected %+v, %v", test, result, err, test.result, test.err)
+		}
+
+		cancel()
+		ci.w.Close()
+	}
+}
+
+// sentSeq returns the sequence number of the next TX command sent to ci
+func sentSeq(t *testing.T, ci *fakeCI) byte {
+	t.Helper()
+
+	frame := <-ci.written
+	packet, err := mci.Unmarshal(frame[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, ok := packet.(mci.TX)
+	if !ok {
+		t.Fatalf("sent %+v, expected TX", packet)
+	}
+	return tx.Seq
+}
@@ -0,0 +1,153 @@
+package xc
+
+import (
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+)
+
+// Number of distinct sample frames kept for each kind of unknown traffic
+const unknownTrafficSamples = 5
+
+// UnknownTraffic describes a kind of message that couldn't be decoded,
+// with sample frames, to help add decoding for new devices
+type UnknownTraffic struct {
+	Reason     string    `json:"reason"`
+	DeviceType int       `json:"device_type,omitempty"`
+	DeviceName string    `json:"device_name,omitempty"`
+	Subtype    int       `json:"subtype,omitempty"`
+	Event      int       `json:"event"`
+	DataType   int       `json:"data_type"`
+	Count      int       `json:"count"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Samples    []string  `json:"samples"`
+}
+
+type unknownTrafficKey struct {
+	reason     string
+	deviceType DeviceType
+	subtype    byte
+	event      byte
+	dataType   byte
+}
+
+type unknownTraffic struct {
+	sync.Mutex
+	entries map[unknownTrafficKey]*UnknownTraffic
+}
+
+// record adds a frame to the registry, and returns true if it's a new kind
+// of traffic or a new sample
+func (u *unknownTraffic) record(key unknownTrafficKey, frame []byte) (UnknownTraffic, bool) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.entries == nil {
+		u.entries = make(map[unknownTrafficKey]*UnknownTraffic)
+	}
+
+	now := time.Now()
+	entry, exists := u.entries[key]
+	if !exists {
+		entry = &UnknownTraffic{
+			Reason:     key.reason,
+			DeviceType: int(key.deviceType),
+			DeviceName: key.deviceType.String(),
+			Subtype:    int(key.subtype),
+			Event:      int(key.event),
+			DataType:   int(key.dataType),
+			FirstSeen:  now,
+		}
+		u.entries[key] = entry
+	}
+	entry.Count++
+	entry.LastSeen = now
+
+	sample := hex.EncodeToString(frame)
+	changed := !exists
+	if len(entry.Samples) < unknownTrafficSamples && !contains(entry.Samples, sample) {
+		entry.Samples = append(entry.Samples, sample)
+		changed = true
+	}
+
+	return entry.copy(), changed
+}
+
+func (u *unknownTraffic) list() []UnknownTraffic {
+	u.Lock()
+	defer u.Unlock()
+
+	list := make([]UnknownTraffic, 0, len(u.entries))
+	for _, entry := range u.entries {
+		list = append(list, entry.copy())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].FirstSeen.Before(list[j].FirstSeen)
+	})
+
+	return list
+}
+
+func (e *UnknownTraffic) copy() UnknownTraffic {
+	c := *e
+	c.Samples = append([]string(nil), e.Samples...)
+	return c
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// UnknownTraffic returns the messages received that couldn't be decoded,
+// in the order they were first seen
+func (i *Interface) UnknownTraffic() []UnknownTraffic {
+	return i.unknownTraffic.list()
+}
+
+// recordUnknown adds a message that couldn't be decoded to the registry,
+// filed under the reason given by err, and notifies the handler if it's new
+func (i *Interface) recordUnknown(packet mci.Packet, frame []byte, err error) {
+	key := unknownTrafficKey{reason: err.Error()}
+
+	var typed notHandledError
+	if errors.As(err, &typed) {
+		key.reason = typed.reason
+	}
+
+	switch p := packet.(type) {
+	case mci.RX:
+		key.event, key.dataType = p.Event, p.DataType
+		if dp, found := i.datapoints[p.Datapoint]; found {
+			key.deviceType, key.subtype = dp.device.deviceType, dp.device.subtype
+		}
+
+	case mci.ExtendedStatus:
+		key.event, key.dataType = RX_EVENT_STATUS_EXT, p.DataType
+		key.deviceType, key.subtype = DeviceType(p.DeviceType), p.Subtype
+
+	case mci.Status:
+		key.event, _ = p.Code()
+		key.dataType = p.Status
+
+	case mci.Extended:
+		key.event = p.Command
+
+	default:
+		key.event = byte(packet.Type())
+	}
+
+	if entry, changed := i.unknownTraffic.record(key, frame); changed {
+		i.handler.UnknownTraffic(entry)
+	}
+}
@@ -0,0 +1,54 @@
+package xc
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/karloygard/xcomfortd-go/pkg/mci"
+)
+
+func TestUnknownTrafficReason(t *testing.T) {
+	tests := []struct {
+		packet mci.Packet
+		reason string
+	}{
+		// Device 1234567 is a switching actuator
+		{mci.ExtendedStatus{DataType: RX_DATA_TYPE_SERIAL_NUMBER, Serial: 1234567,
+			DeviceType: byte(DT_CDAx_01), Data: make([]byte, 9)}, "device type mismatch"},
+		{mci.ExtendedStatus{DataType: RX_DATA_TYPE_SERIAL_NUMBER, Serial: 7654321,
+			DeviceType: byte(DT_CSAx_01), Data: make([]byte, 7)}, "unknown device"},
+		{mci.RX{Datapoint: 99, Event: RX_EVENT_STATUS}, "unknown datapoint"},
+		{mci.RX{Datapoint: 1, Event: 0xEE}, "unknown event"},
+		{mci.RX{Datapoint: 4, Event: RX_EVENT_VALUE, DataType: 0xEE}, "unhandled data type"},
+	}
+
+	for _, test := range tests {
+		i := &Interface{}
+		i.Init(nopHandler{}, false)
+		if err := i.ReadFile("testdata/sample.dpl"); err != nil {
+			t.Fatal(err)
+		}
+
+		frame, err := mci.Marshal(test.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, w := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- i.Run(context.Background(), pipeConn{r})
+		}()
+		w.Write(append([]byte{byte(len(frame) + 1)}, frame...))
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		unknown := i.UnknownTraffic()
+		if len(unknown) != 1 || unknown[0].Reason != test.reason {
+			t.Errorf("%+v filed as %+v, expected reason '%s'", test.packet, unknown, test.reason)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package xc
 import "time"
 
 type waiter struct {
-	consumer chan []byte
+	consumer chan response
 	seq      int
 	started  time.Time
 }
@@ -13,7 +13,7 @@ type waithandler struct {
 	next    int
 }
 
-func (w *waithandler) Add(consumer chan []byte) (int, int) {
+func (w *waithandler) Add(consumer chan response) (int, int) {
 restart:
 	for {
 		w.next = (w.next + 1) % 16
@@ -31,25 +31,38 @@ restart:
 	return w.next, len(w.waiters)
 }
 
+func (w waithandler) Len() int {
+	return len(w.waiters)
+}
+
 func (w waithandler) Close() {
 	for i := range w.waiters {
-		w.waiters[i].consumer <- nil
+		w.waiters[i].consumer <- response{}
 	}
 }
 
 func (w *waithandler) Resume(data []byte, seq int) bool {
+	return w.reply(response{data: data}, seq)
+}
+
+// Fail releases seq, replying with err
+func (w *waithandler) Fail(err error, seq int) bool {
+	return w.reply(response{err: err}, seq)
+}
+
+func (w *waithandler) reply(res response, seq int) bool {
 	for i := range w.waiters {
 		if w.waiters[i].seq == seq {
 			consumer := w.waiters[i].consumer
 			w.waiters = append(w.waiters[:i], w.waiters[i+1:]...)
-			consumer <- data
+			consumer <- res
 			return true
 		}
 	}
 	return false
 }
 
-func (w *waithandler) OldestExpiring(seconds int) <-chan time.Time {
+func (w *waithandler) OldestExpiring(timeout time.Duration) <-chan time.Time {
 	if len(w.waiters) == 0 {
 		return make(chan time.Time)
 	}
@@ -60,7 +73,7 @@ func (w *waithandler) OldestExpiring(seconds int) <-chan time.Time {
 			since = d
 		}
 	}
-	return time.After(time.Duration(seconds)*time.Second - since)
+	return time.After(timeout - since)
 }
 
 func (w *waithandler) ResumeOldest(data []byte) bool {
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// retryableErrorNames returns the names of the errors TX commands may be
+// retried on
+func retryableErrorNames() []string {
+	var names []string
+	for _, r := range xc.RetryableErrors {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+var retryFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "retries",
+		Value: xc.DefaultRetryPolicy().Retries,
+		Usage: "Number of times a failed command is retried",
+	},
+	&cli.DurationFlag{
+		Name:  "retry-backoff",
+		Usage: "Delay before retrying a failed command, doubled for each retry",
+	},
+	&cli.StringSliceFlag{
+		Name:  "retry-on",
+		Value: cli.NewStringSlice(retryableErrorNames()...),
+		Usage: fmt.Sprintf("Errors to retry commands on (%s)", strings.Join(retryableErrorNames(), ", ")),
+	},
+	&cli.DurationFlag{
+		Name:  "tx-timeout",
+		Value: xc.DefaultRetryPolicy().TxTimeout,
+		Usage: "Time to wait for a command to be acknowledged by the stick",
+	},
+	&cli.DurationFlag{
+		Name:  "response-timeout",
+		Value: xc.DefaultRetryPolicy().ResponseTimeout,
+		Usage: "Time to wait for the stick to respond to a config or eprom request before resending it",
+	},
+	&cli.IntFlag{
+		Name:  "response-retries",
+		Value: xc.DefaultRetryPolicy().ResponseRetries,
+		Usage: "Number of times a config or eprom request is resent, negative to resend until interrupted",
+	},
+}
+
+func retryPolicy(c *cli.Context) (xc.RetryPolicy, error) {
+	policy := xc.DefaultRetryPolicy()
+
+	policy.Retries = c.Int("retries")
+	policy.Backoff = c.Duration("retry-backoff")
+	policy.TxTimeout = c.Duration("tx-timeout")
+	policy.ResponseTimeout = c.Duration("response-timeout")
+	policy.ResponseRetries = c.Int("response-retries")
+
+	if policy.TxTimeout <= 0 || policy.ResponseTimeout <= 0 {
+		return policy, errors.New("timeouts must be positive")
+	}
+
+	var retryOn []error
+	for _, name := range c.StringSlice("retry-on") {
+		found := false
+		for _, r := range xc.RetryableErrors {
+			if r.Name == name {
+				retryOn = append(retryOn, r.Err)
+				found = true
+			}
+		}
+		if !found {
+			return policy, errors.Errorf("unknown error '%s' in --retry-on", name)
+		}
+	}
+
+	policy.Retryable = func(err error) bool {
+		for _, e := range retryOn {
+			if errors.Is(err, e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return policy, nil
+}
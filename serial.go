@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"github.com/karloygard/xcomfortd-go/pkg/xc"
+)
+
+// openSerialDevices opens RS232 CIs on the given serial ports.  The CIs
+// must have CRC checksums disabled.
+func openSerialDevices(ports []string, baud int, flowControl bool) (devices []io.ReadWriteCloser, err error) {
+	for i := range ports {
+		var device io.ReadWriteCloser
+
+		if device, err = openSerialPort(ports[i], baud, flowControl); err != nil {
+			return
+		}
+
+		log.Printf("Opened serial port %s, %d baud", ports[i], baud)
+
+		devices = append(devices, xc.StartStopWrap(device))
+	}
+
+	return
+}
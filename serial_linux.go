@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var serialSpeeds = map[int]uint32{
+	1200:  unix.B1200,
+	2400:  unix.B2400,
+	4800:  unix.B4800,
+	9600:  unix.B9600,
+	19200: unix.B19200,
+	38400: unix.B38400,
+	57600: unix.B57600,
+}
+
+// serialSpeedSupported returns whether the serial port can be opened at the
+// given baud rate
+func serialSpeedSupported(baud int) bool {
+	_, found := serialSpeeds[baud]
+	return found
+}
+
+// openSerialPort opens a serial port in raw mode, 8N1, with the given
+// baud rate
+func openSerialPort(name string, baud int, flowControl bool) (io.ReadWriteCloser, error) {
+	speed, found := serialSpeeds[baud]
+	if !found {
+		return nil, errors.Errorf("unsupported baud rate %d", baud)
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	t := unix.Termios{
+		Cflag:  unix.CS8 | unix.CREAD | unix.CLOCAL | speed,
+		Ispeed: speed,
+		Ospeed: speed,
+	}
+	if flowControl {
+		t.Cflag |= unix.CRTSCTS
+	}
+	// Block until at least one byte has been read
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+
+	if err := unix.IoctlSetTermios(int(f.Fd()), unix.TCSETS, &t); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "configuring %s", name)
+	}
+
+	return f, nil
+}
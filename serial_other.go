@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+func serialSpeedSupported(baud int) bool {
+	return false
+}
+
+func openSerialPort(name string, baud int, flowControl bool) (io.ReadWriteCloser, error) {
+	return nil, errors.New("serial ports are only supported on Linux")
+}
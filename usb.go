@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/google/gousb"
 	"github.com/pkg/errors"
@@ -111,3 +114,109 @@ func openUsbDevices(ctx context.Context) (devices []io.ReadWriteCloser, done fun
 
 	return
 }
+
+// usbWatcher opens CKOZ-00/14 sticks as they're plugged in, by enumerating
+// the USB devices periodically
+type usbWatcher struct {
+	usb *gousb.Context
+
+	m sync.Mutex
+	// bus and address of the sticks currently open
+	open map[string]bool
+}
+
+func newUsbWatcher() *usbWatcher {
+	return &usbWatcher{
+		usb:  gousb.NewContext(),
+		open: make(map[string]bool),
+	}
+}
+
+func usbLocation(d *gousb.DeviceDesc) string {
+	return fmt.Sprintf("%d.%d", d.Bus, d.Address)
+}
+
+// Run calls attach for each stick plugged in since the previous scan, in
+// order of serial number, until ctx is cancelled.  The sticks are opened
+// with devCtx.  attach must close the stick when it's no longer used,
+// e.g. when reading fails after it's been unplugged, so that it can be
+// attached again when it reappears.
+func (w *usbWatcher) Run(ctx, devCtx context.Context, interval time.Duration, attach func(io.ReadWriteCloser)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, d := range w.scan(devCtx) {
+			attach(d)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *usbWatcher) scan(ctx context.Context) (devices []io.ReadWriteCloser) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	devs, err := w.usb.OpenDevices(func(d *gousb.DeviceDesc) bool {
+		return d.Vendor == gousb.ID(0x188a) && d.Product == gousb.ID(0x1101) &&
+			!w.open[usbLocation(d)]
+	})
+	if err != nil {
+		log.Printf("Enumerating USB devices: %v", err)
+	}
+
+	devlist := []kv{}
+
+	for i := range devs {
+		location := usbLocation(devs[i].Desc)
+		if d, serial, err := openUsbDevice(ctx, devs[i]); err != nil {
+			log.Printf("Opening USB device %s: %+v", location, err)
+			devs[i].Close()
+		} else {
+			w.open[location] = true
+			devlist = append(devlist, kv{
+				serial: serial,
+				device: watchedDevice{d, func() { w.closed(location) }},
+			})
+		}
+	}
+
+	// Ensure order doesn't change
+	sort.Slice(devlist, func(i, j int) bool {
+		return devlist[i].serial < devlist[j].serial
+	})
+
+	for _, d := range devlist {
+		devices = append(devices, d.device)
+	}
+
+	return
+}
+
+func (w *usbWatcher) closed(location string) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	delete(w.open, location)
+}
+
+// Close must be called after all attached sticks have been closed
+func (w *usbWatcher) Close() error {
+	return w.usb.Close()
+}
+
+type watchedDevice struct {
+	io.ReadWriteCloser
+	closed func()
+}
+
+func (d watchedDevice) Close() error {
+	err := d.ReadWriteCloser.Close()
+	d.closed()
+	return err
+}